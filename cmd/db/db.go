@@ -1,27 +1,161 @@
 package main
 
 import (
+	"context"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"flag"
-	"io/ioutil"
+	"fmt"
+	"io"
 	"log"
 	"net/http"
+	"os"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/yaryna-bashchak/kpi-architecture-lab-4/datastore"
 	"github.com/yaryna-bashchak/kpi-architecture-lab-4/httptools"
 	"github.com/yaryna-bashchak/kpi-architecture-lab-4/signal"
 )
 
-var port = flag.Int("port", 8083, "server port")
+const (
+	confDir         = "CONF_DB_DIR"
+	confSegmentSize = "CONF_DB_SEGMENT_SIZE"
+	confSync        = "CONF_DB_SYNC"
+	confRepair      = "CONF_DB_REPAIR"
+	confCompaction  = "CONF_DB_COMPACTION"
+	confReplicaOf   = "CONF_DB_REPLICA_OF"
+)
+
+// Values of the "type" query parameter.
+const (
+	typeString = "string"
+	typeInt64  = "int64"
+	typeBytes  = "bytes"
+)
 
+const incrSuffix = "/incr"
+
+// GET /db/<namespace>/_watch streams the change feed as Server-Sent Events,
+// with a comment line every watchHeartbeat to keep idle connections open.
+const (
+	watchKey       = "_watch"
+	watchHeartbeat = 15 * time.Second
+)
+
+const (
+	defaultListLimit = 100
+	maxListLimit     = 1000
+)
+
+const (
+	batchKey    = "_batch"
+	batchPut    = "put"
+	batchDelete = "delete"
+)
+
+var (
+	port        = flag.Int("port", 8083, "server port")
+	dir         = flag.String("dir", envString(confDir, "data"), "directory to keep segment files in")
+	segmentSize = flag.Int64("segment-size", envInt64(confSegmentSize, 10*1024*1024), "max size of a segment file in bytes")
+	repair      = flag.Bool("repair", envBool(confRepair, false), "whether to truncate damaged segment tails instead of refusing to start")
+	syncPolicy  = flag.String("sync", envString(confSync, "never"), "when to fsync segment files: never, always or an interval like 100ms")
+	compaction  = flag.String("compaction", envString(confCompaction, "segments=3"), "when to merge segments: off or a comma separated list of segments=N, dead-ratio=R and interval=D")
+	replicaOf   = flag.String("replica-of", envString(confReplicaOf, ""), "URL of the leader to follow, like http://db:8083; a follower redirects writes there")
+)
+
+// RespBody is the response of GET /db/<namespace>/<key>. ExpiresAt is set
+// for values stored with a TTL.
 type RespBody struct {
-	Key   string `json:"key"`
-	Value string `json:"value"`
+	Key       string     `json:"key"`
+	Value     string     `json:"value"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
 }
 
+// ReqBody is the body of POST /db/<namespace>/<key>. The optional TTL is a
+// duration such as "90s" after which the value expires.
 type ReqBody struct {
 	Value string `json:"value"`
+	TTL   string `json:"ttl,omitempty"`
+}
+
+type Int64RespBody struct {
+	Key   string `json:"key"`
+	Value int64  `json:"value"`
+}
+
+type Int64ReqBody struct {
+	Value int64 `json:"value"`
+}
+
+// BatchOp is a single operation of a POST /db/<namespace>/_batch request.
+type BatchOp struct {
+	Op    string `json:"op"`
+	Key   string `json:"key"`
+	Value string `json:"value,omitempty"`
+}
+
+// ListRespBody is the response of GET /db/<namespace>/?prefix=<prefix>.
+// NextCursor is passed as the cursor parameter to get the following page; it
+// is empty on the last page.
+type ListRespBody struct {
+	Items      []ListItem `json:"items"`
+	NextCursor string     `json:"next_cursor,omitempty"`
+}
+
+// ListItem is a key of a list response. Int64 values are formatted in
+// decimal and bytes values are base64 encoded.
+type ListItem struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+	Type  string `json:"type"`
+}
+
+// WatchEvent is the data of an event of GET /db/<namespace>/_watch. Values
+// are formatted as in ListItem and left out of delete events.
+type WatchEvent struct {
+	Key       string     `json:"key"`
+	Value     string     `json:"value,omitempty"`
+	Type      string     `json:"type,omitempty"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+}
+
+// ReplicationRespBody is the response of GET
+// /admin/replication?namespace=<name>. Version is the sequence number of the
+// last write of the namespace. Followers also report the version of their
+// leader, how many writes they are behind and, in LagMs, for how long they
+// have not been caught up. Connected tells whether a follower is tailing the
+// change feed of its leader.
+type ReplicationRespBody struct {
+	Role          string     `json:"role"`
+	Version       int64      `json:"version"`
+	Leader        string     `json:"leader,omitempty"`
+	LeaderVersion int64      `json:"leader_version,omitempty"`
+	Lag           int64      `json:"lag"`
+	LagMs         int64      `json:"lag_ms"`
+	Connected     bool       `json:"connected"`
+	LastContact   *time.Time `json:"last_contact,omitempty"`
+	LastError     string     `json:"last_error,omitempty"`
+}
+
+// CompactionRespBody is the response of GET /admin/compaction.
+type CompactionRespBody struct {
+	Running             bool       `json:"running"`
+	Progress            float64    `json:"progress"`
+	Compactions         int        `json:"compactions"`
+	LastStarted         *time.Time `json:"last_started,omitempty"`
+	LastDurationMs      int64      `json:"last_duration_ms"`
+	LastBytesReclaimed  int64      `json:"last_bytes_reclaimed"`
+	TotalBytesReclaimed int64      `json:"total_bytes_reclaimed"`
+	LastError           string     `json:"last_error,omitempty"`
+}
+
+// IncrReqBody is the optional body of an increment request, delta defaults
+// to 1.
+type IncrReqBody struct {
+	Delta int64 `json:"delta"`
 }
 
 type server struct {
@@ -32,19 +166,35 @@ func main() {
 	flag.Parse()
 
 	s := &server{ServeMux: http.NewServeMux()}
-	dir, err := ioutil.TempDir("", "temp-dir")
+	if err := os.MkdirAll(*dir, 0o755); err != nil {
+		log.Fatal(err)
+	}
+	syncOpt, err := parseSyncPolicy(*syncPolicy)
 	if err != nil {
 		log.Fatal(err)
 	}
-	db, err := datastore.NewDb(dir, 250)
+	var policy datastore.CompactionPolicy
+	if err := parseCompactionPolicy(*compaction, &policy); err != nil {
+		log.Fatal(err)
+	}
+	opts := []datastore.Option{datastore.WithSegmentSize(*segmentSize), syncOpt, datastore.WithCompaction(policy)}
+	if *repair {
+		opts = append(opts, datastore.WithRepair())
+	}
+	spaces, err := openNamespaces(*dir, opts...)
 	if err != nil {
 		log.Fatal(err)
 	}
-	defer db.Close()
+	defer spaces.close()
 
-	s.HandleFunc("/db/", func(rw http.ResponseWriter, req *http.Request) {
-		handleDBRequest(rw, req, db)
-	})
+	var r *replicator
+	if *replicaOf != "" {
+		r = newReplicator(strings.TrimSuffix(*replicaOf, "/"), spaces)
+		r.start()
+		defer r.stop()
+		log.Printf("Following %s", r.leader)
+	}
+	s.routes(spaces, r)
 
 	httpServer := httptools.CreateServer(*port, s)
 	httpServer.Start()
@@ -52,6 +202,43 @@ func main() {
 	signal.WaitForTerminationSignal()
 }
 
+// routes registers the handlers of the server; r is nil on a leader.
+func (s *server) routes(spaces *namespaces, r *replicator) {
+	// leaderOnly sends the writes a follower gets to its leader.
+	leaderOnly := func(handler http.HandlerFunc) http.HandlerFunc {
+		return func(rw http.ResponseWriter, req *http.Request) {
+			if r != nil && req.Method != http.MethodGet {
+				// 307 keeps the method and the body of the request.
+				http.Redirect(rw, req, r.leader+req.URL.RequestURI(), http.StatusTemporaryRedirect)
+				return
+			}
+			handler(rw, req)
+		}
+	}
+
+	s.HandleFunc("/db/", leaderOnly(func(rw http.ResponseWriter, req *http.Request) {
+		handleNamespaceRequest(rw, req, spaces)
+	}))
+	s.HandleFunc("/admin/namespaces", func(rw http.ResponseWriter, req *http.Request) {
+		handleNamespaceList(rw, req, spaces)
+	})
+	s.HandleFunc("/admin/namespaces/", leaderOnly(func(rw http.ResponseWriter, req *http.Request) {
+		handleNamespace(rw, req, spaces)
+	}))
+	s.HandleFunc("/admin/replication", withNamespace(spaces, func(rw http.ResponseWriter, req *http.Request, ns *namespace) {
+		handleReplication(rw, req, r, ns)
+	}))
+	s.HandleFunc("/admin/compact", withNamespace(spaces, func(rw http.ResponseWriter, req *http.Request, ns *namespace) {
+		handleCompact(rw, req, ns.db)
+	}))
+	s.HandleFunc("/admin/compaction", withNamespace(spaces, func(rw http.ResponseWriter, req *http.Request, ns *namespace) {
+		handleCompactionStats(rw, req, ns.db)
+	}))
+	s.HandleFunc("/admin/backup", withNamespace(spaces, func(rw http.ResponseWriter, req *http.Request, ns *namespace) {
+		handleBackup(rw, req, ns.db)
+	}))
+}
+
 func (s *server) Start() {
 	log.Printf("Server listening on port %d", *port)
 	err := http.ListenAndServe(":"+strconv.Itoa(*port), s)
@@ -60,40 +247,679 @@ func (s *server) Start() {
 	}
 }
 
-func handleDBRequest(rw http.ResponseWriter, req *http.Request, Db *datastore.Db) {
+// handleNamespaceRequest passes a request for /db/<namespace>/<key> to the
+// store of the namespace. Writes create missing namespaces and are refused
+// once the namespace is over its quota. Only a list has no key.
+func handleNamespaceRequest(rw http.ResponseWriter, req *http.Request, spaces *namespaces) {
+	name, key, _ := strings.Cut(req.URL.Path[len("/db/"):], "/")
+	if key == "" && req.Method != http.MethodGet {
+		rw.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	write := req.Method == http.MethodPost
+	ns, err := spaces.acquire(name, write)
+	if err != nil {
+		rw.WriteHeader(errorStatus(err))
+		return
+	}
+	defer ns.release()
+	if write {
+		if err := ns.checkQuota(); err != nil {
+			rw.WriteHeader(errorStatus(err))
+			return
+		}
+	}
+
+	// Dropping the namespace ends its change feeds.
+	ctx, cancel := ns.context(req.Context())
+	defer cancel()
+	handleDBRequest(rw, req.WithContext(ctx), key, ns.db)
+}
+
+func handleDBRequest(rw http.ResponseWriter, req *http.Request, key string, Db *datastore.Db) {
 	log.Println("Caught request")
-	key := req.URL.Path[len("/db/"):]
 	log.Printf("Key: %s", key)
 
+	valueType := req.URL.Query().Get("type")
+	if valueType != "" && valueType != typeString && valueType != typeInt64 && valueType != typeBytes {
+		rw.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	if key == "" && req.Method == http.MethodGet {
+		handleList(rw, req, Db)
+		return
+	}
+	if key == watchKey && req.Method == http.MethodGet {
+		handleWatch(rw, req, Db)
+		return
+	}
+	if key == batchKey && req.Method == http.MethodPost {
+		handleBatch(rw, req, Db)
+		return
+	}
+	if strings.HasSuffix(key, incrSuffix) && req.Method == http.MethodPost {
+		handleIncrement(rw, req, strings.TrimSuffix(key, incrSuffix), Db)
+		return
+	}
+
 	switch req.Method {
 	case http.MethodGet:
-		value, err := Db.Get(key)
+		handleGet(rw, key, valueType, Db)
+	case http.MethodPost:
+		handlePost(rw, req, key, valueType, Db)
+	case http.MethodDelete:
+		err := Db.Delete(key)
 		if err != nil {
-			rw.WriteHeader(http.StatusNotFound)
+			rw.WriteHeader(http.StatusInternalServerError)
 			return
 		}
 		rw.WriteHeader(http.StatusOK)
-		rw.Header().Set("content-type", "application/json")
-		_ = json.NewEncoder(rw).Encode(RespBody{
-			Key:   key,
-			Value: value,
-		})
-	case http.MethodPost:
-		var body ReqBody
+	default:
+		rw.WriteHeader(http.StatusBadRequest)
+	}
+}
 
-		err := json.NewDecoder(req.Body).Decode(&body)
+func handleGet(rw http.ResponseWriter, key, valueType string, Db *datastore.Db) {
+	var body interface{}
+	switch valueType {
+	case typeInt64:
+		value, err := Db.GetInt64(key)
 		if err != nil {
-			rw.WriteHeader(http.StatusBadRequest)
+			rw.WriteHeader(errorStatus(err))
+			return
+		}
+		body = Int64RespBody{Key: key, Value: value}
+	case typeBytes:
+		value, err := Db.GetBytes(key)
+		if err != nil {
+			rw.WriteHeader(errorStatus(err))
+			return
+		}
+		rw.Header().Set("content-type", "application/octet-stream")
+		rw.WriteHeader(http.StatusOK)
+		_, _ = rw.Write(value)
+		return
+	default:
+		item, err := Db.GetItem(key)
+		if err != nil {
+			rw.WriteHeader(errorStatus(err))
 			return
 		}
+		resp := RespBody{Key: key, Value: item.Value}
+		if !item.ExpiresAt.IsZero() {
+			resp.ExpiresAt = &item.ExpiresAt
+		}
+		rw.Header().Set("etag", formatETag(item.Version))
+		body = resp
+	}
+
+	rw.Header().Set("content-type", "application/json")
+	rw.WriteHeader(http.StatusOK)
+	_ = json.NewEncoder(rw).Encode(body)
+}
+
+func handlePost(rw http.ResponseWriter, req *http.Request, key, valueType string, Db *datastore.Db) {
+	if req.Header.Get("if-match") != "" || req.Header.Get("if-none-match") != "" {
+		handleConditionalPost(rw, req, key, valueType, Db)
+		return
+	}
+	value, ok := readPostValue(req, valueType)
+	if !ok {
+		rw.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	var err error
+	switch {
+	case valueType == typeInt64:
+		err = Db.PutInt64(key, value.int64)
+	case valueType == typeBytes:
+		err = Db.PutBytes(key, value.bytes)
+	case value.ttl > 0:
+		err = Db.PutWithTTL(key, value.str, value.ttl)
+	default:
+		err = Db.Put(key, value.str)
+	}
+
+	if err != nil {
+		rw.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	rw.WriteHeader(http.StatusCreated)
+}
+
+// postValue is the value of a POST /db/<namespace>/<key> request, in the
+// field of its type.
+type postValue struct {
+	str   string
+	int64 int64
+	bytes []byte
+	ttl   time.Duration
+}
 
-		err = Db.Put(key, body.Value)
+// readPostValue decodes the body of a POST request for the value type.
+func readPostValue(req *http.Request, valueType string) (postValue, bool) {
+	var value postValue
+	switch valueType {
+	case typeInt64:
+		var body Int64ReqBody
+		if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+			return value, false
+		}
+		value.int64 = body.Value
+	case typeBytes:
+		data, err := io.ReadAll(req.Body)
 		if err != nil {
-			rw.WriteHeader(http.StatusInternalServerError)
+			return value, false
+		}
+		value.bytes = data
+	default:
+		var body ReqBody
+		if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+			return value, false
+		}
+		value.str = body.Value
+		if body.TTL != "" {
+			ttl, err := time.ParseDuration(body.TTL)
+			if err != nil || ttl <= 0 {
+				return value, false
+			}
+			value.ttl = ttl
+		}
+	}
+	return value, true
+}
+
+// handleConditionalPost stores a value only if the precondition holds:
+// If-None-Match: * for a missing key, or, for string values without a TTL,
+// If-Match with the ETag of the current value or * for any existing value.
+// If-Match compares ETags strongly, so weak ones never match. A failed
+// precondition is answered with 412 and the new ETag is returned on success.
+func handleConditionalPost(rw http.ResponseWriter, req *http.Request, key, valueType string, Db *datastore.Db) {
+	match := strings.TrimSpace(req.Header.Get("if-match"))
+	if match == "" && req.Header.Get("if-none-match") != "*" {
+		rw.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	value, ok := readPostValue(req, valueType)
+	if !ok {
+		rw.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	isString := valueType == "" || valueType == typeString
+	if match != "" && (!isString || value.ttl > 0) {
+		rw.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	var version int64
+	var err error
+	switch {
+	case match == "*":
+		version, err = Db.PutIfExists(key, value.str)
+	case strings.HasPrefix(match, "W/"):
+		rw.WriteHeader(http.StatusPreconditionFailed)
+		return
+	case match != "":
+		expected, ok := parseETag(match)
+		if !ok {
+			rw.WriteHeader(http.StatusBadRequest)
 			return
 		}
-		rw.WriteHeader(http.StatusCreated)
+		version, err = Db.CompareAndSwap(key, expected, value.str)
+	case valueType == typeInt64:
+		version, err = Db.PutInt64IfAbsent(key, value.int64)
+	case valueType == typeBytes:
+		version, err = Db.PutBytesIfAbsent(key, value.bytes)
+	case value.ttl > 0:
+		version, err = Db.PutWithTTLIfAbsent(key, value.str, value.ttl)
 	default:
+		version, err = Db.PutIfAbsent(key, value.str)
+	}
+
+	if err != nil {
+		rw.WriteHeader(errorStatus(err))
+		return
+	}
+	rw.Header().Set("etag", formatETag(version))
+	rw.WriteHeader(http.StatusCreated)
+}
+
+// formatETag returns the ETag of a record version.
+func formatETag(version int64) string {
+	return strconv.Quote(strconv.FormatInt(version, 10))
+}
+
+func parseETag(etag string) (int64, bool) {
+	value, err := strconv.Unquote(etag)
+	if err != nil {
+		return 0, false
+	}
+	version, err := strconv.ParseInt(value, 10, 64)
+	return version, err == nil
+}
+
+func handleList(rw http.ResponseWriter, req *http.Request, Db *datastore.Db) {
+	query := req.URL.Query()
+	limit := defaultListLimit
+	if value := query.Get("limit"); value != "" {
+		var err error
+		limit, err = strconv.Atoi(value)
+		if err != nil || limit <= 0 || limit > maxListLimit {
+			rw.WriteHeader(http.StatusBadRequest)
+			return
+		}
+	}
+
+	it := Db.Iterator(query.Get("prefix"))
+	defer it.Close()
+	it.Seek(query.Get("cursor"))
+	body := ListRespBody{Items: make([]ListItem, 0)}
+	for it.Next() {
+		if len(body.Items) == limit {
+			body.NextCursor = it.Key()
+			break
+		}
+		item := ListItem{Key: it.Key(), Value: it.Value(), Type: it.Type().String()}
+		switch it.Type() {
+		case datastore.TypeInt64:
+			value, err := it.Int64()
+			if err != nil {
+				rw.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			item.Value = strconv.FormatInt(value, 10)
+		case datastore.TypeBytes:
+			item.Value = base64.StdEncoding.EncodeToString([]byte(it.Value()))
+		}
+		body.Items = append(body.Items, item)
+	}
+	if err := it.Err(); err != nil {
+		rw.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	rw.Header().Set("content-type", "application/json")
+	rw.WriteHeader(http.StatusOK)
+	_ = json.NewEncoder(rw).Encode(body)
+}
+
+// handleWatch streams the writes to keys with the prefix parameter as
+// Server-Sent Events. The from parameter, or the Last-Event-ID header of a
+// reconnecting client, replays the writes after that sequence number first.
+// If a compaction merged some of them, it answers 410 and the client has to
+// start over from a backup.
+func handleWatch(rw http.ResponseWriter, req *http.Request, Db *datastore.Db) {
+	flusher, ok := rw.(http.Flusher)
+	if !ok {
+		rw.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	prefix := req.URL.Query().Get("prefix")
+	from := req.URL.Query().Get("from")
+	if id := req.Header.Get("Last-Event-ID"); id != "" {
+		from = id
+	}
+
+	var events <-chan datastore.Event
+	if from == "" {
+		events = Db.Watch(req.Context(), prefix)
+	} else {
+		seq, err := strconv.ParseInt(from, 10, 64)
+		if err != nil || seq < 0 {
+			rw.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if events, err = Db.WatchFrom(req.Context(), prefix, seq); err != nil {
+			rw.WriteHeader(errorStatus(err))
+			return
+		}
+	}
+
+	// The stream outlives the write timeout of the server.
+	_ = http.NewResponseController(rw).SetWriteDeadline(time.Time{})
+	rw.Header().Set("content-type", "text/event-stream")
+	rw.Header().Set("cache-control", "no-cache")
+	rw.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	heartbeat := time.NewTicker(watchHeartbeat)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case e, ok := <-events:
+			if !ok {
+				return
+			}
+			data := WatchEvent{Key: e.Key}
+			if e.Type == datastore.EventPut {
+				data.Value, data.Type = e.Value, e.ValueType.String()
+				if !e.ExpiresAt.IsZero() {
+					data.ExpiresAt = &e.ExpiresAt
+				}
+				switch e.ValueType {
+				case datastore.TypeInt64:
+					value, err := e.Int64()
+					if err != nil {
+						log.Printf("Bad int64 value of %s in the change feed: %s", e.Key, err)
+						return
+					}
+					data.Value = strconv.FormatInt(value, 10)
+				case datastore.TypeBytes:
+					data.Value = base64.StdEncoding.EncodeToString([]byte(e.Value))
+				}
+			}
+			encoded, err := json.Marshal(data)
+			if err != nil {
+				return
+			}
+			if _, err := fmt.Fprintf(rw, "id: %d\nevent: %s\ndata: %s\n\n", e.Seq, e.Type, encoded); err != nil {
+				return
+			}
+		case <-heartbeat.C:
+			if _, err := io.WriteString(rw, ": heartbeat\n\n"); err != nil {
+				return
+			}
+		}
+		flusher.Flush()
+	}
+}
+
+func handleIncrement(rw http.ResponseWriter, req *http.Request, key string, Db *datastore.Db) {
+	body := IncrReqBody{Delta: 1}
+	err := json.NewDecoder(req.Body).Decode(&body)
+	if err != nil && err != io.EOF {
+		rw.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	value, err := Db.Increment(key, body.Delta)
+	if err != nil {
+		rw.WriteHeader(errorStatus(err))
+		return
+	}
+	rw.Header().Set("content-type", "application/json")
+	rw.WriteHeader(http.StatusOK)
+	_ = json.NewEncoder(rw).Encode(Int64RespBody{Key: key, Value: value})
+}
+
+func handleBatch(rw http.ResponseWriter, req *http.Request, Db *datastore.Db) {
+	var ops []BatchOp
+	if err := json.NewDecoder(req.Body).Decode(&ops); err != nil {
 		rw.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	var batch datastore.Batch
+	for _, op := range ops {
+		switch op.Op {
+		case batchPut:
+			batch.Put(op.Key, op.Value)
+		case batchDelete:
+			batch.Delete(op.Key)
+		default:
+			rw.WriteHeader(http.StatusBadRequest)
+			return
+		}
+	}
+
+	if err := Db.Write(&batch); err != nil {
+		rw.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	rw.WriteHeader(http.StatusCreated)
+}
+
+// handleCompact runs a full compaction and answers once it is done. The
+// compaction is abandoned if the client goes away.
+func handleCompact(rw http.ResponseWriter, req *http.Request, Db *datastore.Db) {
+	if req.Method != http.MethodPost {
+		rw.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if err := Db.Compact(req.Context()); err != nil {
+		log.Printf("Compaction failed: %s", err)
+		rw.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	handleCompactionStats(rw, req, Db)
+}
+
+func handleCompactionStats(rw http.ResponseWriter, req *http.Request, Db *datastore.Db) {
+	if req.Method != http.MethodGet && req.Method != http.MethodPost {
+		rw.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	stats := Db.CompactionStats()
+	body := CompactionRespBody{
+		Running:             stats.Running,
+		Progress:            stats.Progress,
+		Compactions:         stats.Compactions,
+		LastDurationMs:      stats.LastDuration.Milliseconds(),
+		LastBytesReclaimed:  stats.LastBytesReclaimed,
+		TotalBytesReclaimed: stats.TotalBytesReclaimed,
+		LastError:           stats.LastError,
+	}
+	if !stats.LastStarted.IsZero() {
+		body.LastStarted = &stats.LastStarted
+	}
+	rw.Header().Set("content-type", "application/json")
+	rw.WriteHeader(http.StatusOK)
+	_ = json.NewEncoder(rw).Encode(body)
+}
+
+// handleBackup streams a tar archive of the store. Once the archive has
+// started, errors can only be logged and the client gets a truncated archive.
+// The archive also ends when the request is cancelled.
+func handleBackup(rw http.ResponseWriter, req *http.Request, Db *datastore.Db) {
+	if req.Method != http.MethodGet {
+		rw.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	rw.Header().Set("content-type", "application/x-tar")
+	rw.Header().Set("content-disposition", `attachment; filename="backup.tar"`)
+	rw.WriteHeader(http.StatusOK)
+	if err := Db.Backup(&contextWriter{ctx: req.Context(), w: rw}); err != nil {
+		log.Printf("Backup failed: %s", err)
+	}
+}
+
+// contextWriter fails the writes once its context is done.
+type contextWriter struct {
+	ctx context.Context
+	w   io.Writer
+}
+
+func (cw *contextWriter) Write(p []byte) (int, error) {
+	if err := cw.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return cw.w.Write(p)
+}
+
+// handleReplication reports the replication state of a namespace; r is nil
+// on a leader.
+func handleReplication(rw http.ResponseWriter, req *http.Request, r *replicator, ns *namespace) {
+	if req.Method != http.MethodGet {
+		rw.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	body := ReplicationRespBody{Role: "leader", Version: ns.db.Version()}
+	if r != nil {
+		var ok bool
+		if body, ok = r.status(ns.name); !ok {
+			rw.WriteHeader(http.StatusNotFound)
+			return
+		}
+	}
+	rw.Header().Set("content-type", "application/json")
+	rw.WriteHeader(http.StatusOK)
+	_ = json.NewEncoder(rw).Encode(body)
+}
+
+// withNamespace passes the namespace named by the namespace parameter,
+// the default one if it is missing, to an admin handler. Dropping the
+// namespace cancels the request, ending a backup or a compaction.
+func withNamespace(spaces *namespaces, handler func(rw http.ResponseWriter, req *http.Request, ns *namespace)) http.HandlerFunc {
+	return func(rw http.ResponseWriter, req *http.Request) {
+		name := req.URL.Query().Get("namespace")
+		if name == "" {
+			name = defaultNamespace
+		}
+		ns, err := spaces.acquire(name, false)
+		if err != nil {
+			rw.WriteHeader(errorStatus(err))
+			return
+		}
+		defer ns.release()
+		ctx, cancel := ns.context(req.Context())
+		defer cancel()
+		handler(rw, req.WithContext(ctx), ns)
+	}
+}
+
+// handleNamespaceList describes the namespaces.
+func handleNamespaceList(rw http.ResponseWriter, req *http.Request, spaces *namespaces) {
+	if req.Method != http.MethodGet {
+		rw.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	infos, err := spaces.list()
+	if err != nil {
+		rw.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	rw.Header().Set("content-type", "application/json")
+	rw.WriteHeader(http.StatusOK)
+	_ = json.NewEncoder(rw).Encode(infos)
+}
+
+// handleNamespace creates or updates a namespace with PUT, answering 201 for
+// a new one, and drops it and its files with DELETE.
+func handleNamespace(rw http.ResponseWriter, req *http.Request, spaces *namespaces) {
+	name := req.URL.Path[len("/admin/namespaces/"):]
+	switch req.Method {
+	case http.MethodPut:
+		var config NamespaceConfig
+		if err := json.NewDecoder(req.Body).Decode(&config); err != nil && err != io.EOF {
+			rw.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if config.SegmentSize < 0 || config.MaxBytes < 0 {
+			rw.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		created, err := spaces.put(name, config)
+		if err != nil {
+			log.Printf("Cannot put namespace %s: %s", name, err)
+			rw.WriteHeader(errorStatus(err))
+			return
+		}
+		if created {
+			rw.WriteHeader(http.StatusCreated)
+			return
+		}
+		rw.WriteHeader(http.StatusOK)
+	case http.MethodDelete:
+		if err := spaces.remove(name); err != nil {
+			log.Printf("Cannot drop namespace %s: %s", name, err)
+			rw.WriteHeader(errorStatus(err))
+			return
+		}
+		rw.WriteHeader(http.StatusOK)
+	default:
+		rw.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func errorStatus(err error) int {
+	switch {
+	case errors.Is(err, errNamespaceNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, errBadNamespace), errors.Is(err, datastore.ErrInvalidOption):
+		return http.StatusBadRequest
+	case errors.Is(err, errDropDefault), errors.Is(err, errSegmentSizeFixed), errors.Is(err, errNamespaceDropping):
+		return http.StatusConflict
+	case errors.Is(err, errQuotaExceeded):
+		return http.StatusInsufficientStorage
+	case errors.Is(err, datastore.ErrNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, datastore.ErrWrongType):
+		return http.StatusConflict
+	case errors.Is(err, datastore.ErrVersionMismatch), errors.Is(err, datastore.ErrKeyExists):
+		return http.StatusPreconditionFailed
+	case errors.Is(err, datastore.ErrCompacted):
+		return http.StatusGone
+	default:
+		return http.StatusInternalServerError
+	}
+}
+func envString(name, def string) string {
+	if value, ok := os.LookupEnv(name); ok {
+		return value
+	}
+	return def
+}
+
+func envInt64(name string, def int64) int64 {
+	if value, err := strconv.ParseInt(os.Getenv(name), 10, 64); err == nil {
+		return value
+	}
+	return def
+}
+
+func envBool(name string, def bool) bool {
+	if value, err := strconv.ParseBool(os.Getenv(name)); err == nil {
+		return value
+	}
+	return def
+}
+
+// parseSyncPolicy returns the sync option of a -sync flag value.
+func parseSyncPolicy(policy string) (datastore.Option, error) {
+	switch policy {
+	case "never", "false":
+		return datastore.WithSync(datastore.SyncNever), nil
+	case "always", "true":
+		return datastore.WithSync(datastore.SyncAlways), nil
+	}
+	interval, err := time.ParseDuration(policy)
+	if err != nil {
+		return nil, fmt.Errorf("bad sync policy %q: %w", policy, err)
+	}
+	return datastore.WithSyncInterval(interval), nil
+}
+
+// parseCompactionPolicy fills the compaction policy from a -compaction flag
+// value.
+func parseCompactionPolicy(value string, policy *datastore.CompactionPolicy) error {
+	if value == "off" {
+		policy.Disabled = true
+		return nil
+	}
+
+	// Only the listed triggers are used.
+	policy.MaxSegments = -1
+	for _, part := range strings.Split(value, ",") {
+		name, arg, ok := strings.Cut(part, "=")
+		if !ok {
+			return fmt.Errorf("bad compaction trigger %q", part)
+		}
+		var err error
+		switch name {
+		case "segments":
+			policy.MaxSegments, err = strconv.Atoi(arg)
+		case "dead-ratio":
+			policy.DeadRatio, err = strconv.ParseFloat(arg, 64)
+		case "interval":
+			policy.Interval, err = time.ParseDuration(arg)
+		default:
+			return fmt.Errorf("unknown compaction trigger %q", name)
+		}
+		if err != nil {
+			return fmt.Errorf("bad compaction trigger %q: %w", part, err)
+		}
 	}
-}
\ No newline at end of file
+	return nil
+}
@@ -0,0 +1,395 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/yaryna-bashchak/kpi-architecture-lab-4/datastore"
+)
+
+func newTestDb(t *testing.T) *datastore.Db {
+	t.Helper()
+	db, err := datastore.Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+// serveKey runs a request for the key against the store.
+func serveKey(db *datastore.Db, method, key string, header map[string]string, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, "/db/default/"+key, strings.NewReader(body))
+	for name, value := range header {
+		req.Header.Set(name, value)
+	}
+	rw := httptest.NewRecorder()
+	handleDBRequest(rw, req, key, db)
+	return rw
+}
+
+func TestConditionalPost(t *testing.T) {
+	db := newTestDb(t)
+	value := `{"value":"v"}`
+
+	cases := []struct {
+		name   string
+		header map[string]string
+		status int
+		etag   string
+	}{
+		{"any version of a missing key", map[string]string{"If-Match": "*"}, http.StatusPreconditionFailed, ""},
+		{"absent key", map[string]string{"If-None-Match": "*"}, http.StatusCreated, `"1"`},
+		{"present key", map[string]string{"If-None-Match": "*"}, http.StatusPreconditionFailed, ""},
+		{"any version", map[string]string{"If-Match": "*"}, http.StatusCreated, `"2"`},
+		{"weak tag", map[string]string{"If-Match": `W/"2"`}, http.StatusPreconditionFailed, ""},
+		{"stale tag", map[string]string{"If-Match": `"1"`}, http.StatusPreconditionFailed, ""},
+		{"current tag", map[string]string{"If-Match": `"2"`}, http.StatusCreated, `"3"`},
+		{"bad tag", map[string]string{"If-Match": "2"}, http.StatusBadRequest, ""},
+	}
+	for _, c := range cases {
+		rw := serveKey(db, http.MethodPost, "key", c.header, value)
+		if rw.Code != c.status {
+			t.Errorf("%s: expected %d, got %d", c.name, c.status, rw.Code)
+		}
+		if etag := rw.Header().Get("etag"); etag != c.etag {
+			t.Errorf("%s: expected ETag %s, got %s", c.name, c.etag, etag)
+		}
+	}
+}
+
+func TestConditionalPost_Types(t *testing.T) {
+	db := newTestDb(t)
+
+	cases := []struct {
+		name   string
+		key    string
+		query  string
+		body   string
+		status int
+	}{
+		{"absent int64", "int", "?type=int64", `{"value":1}`, http.StatusCreated},
+		{"present int64", "int", "?type=int64", `{"value":2}`, http.StatusPreconditionFailed},
+		{"absent bytes", "bytes", "?type=bytes", "data", http.StatusCreated},
+		{"present bytes", "bytes", "?type=bytes", "other", http.StatusPreconditionFailed},
+		{"value of another type", "int", "", `{"value":"v"}`, http.StatusPreconditionFailed},
+		{"absent with ttl", "ttl", "", `{"value":"v","ttl":"1h"}`, http.StatusCreated},
+		{"present with ttl", "ttl", "", `{"value":"w","ttl":"1h"}`, http.StatusPreconditionFailed},
+		{"bad ttl", "other", "", `{"value":"v","ttl":"-1s"}`, http.StatusBadRequest},
+	}
+	for _, c := range cases {
+		req := httptest.NewRequest(http.MethodPost, "/db/default/"+c.key+c.query, strings.NewReader(c.body))
+		req.Header.Set("If-None-Match", "*")
+		rw := httptest.NewRecorder()
+		handleDBRequest(rw, req, c.key, db)
+		if rw.Code != c.status {
+			t.Errorf("%s: expected %d, got %d", c.name, c.status, rw.Code)
+		}
+	}
+
+	if n, _ := db.GetInt64("int"); n != 1 {
+		t.Errorf("Expected int to stay 1, got %d", n)
+	}
+	if value, _ := db.GetBytes("bytes"); string(value) != "data" {
+		t.Errorf("Expected bytes to stay data, got %q", value)
+	}
+	if item, _ := db.GetItem("ttl"); item.Value != "v" || item.ExpiresAt.IsZero() {
+		t.Errorf("Expected ttl to keep v with an expiry time, got %+v", item)
+	}
+	rw := serveKey(db, http.MethodPost, "ttl", map[string]string{"If-Match": "*"}, `{"value":"w","ttl":"1h"}`)
+	if rw.Code != http.StatusBadRequest {
+		t.Errorf("If-Match with a TTL: expected 400, got %d", rw.Code)
+	}
+}
+
+func TestDelete(t *testing.T) {
+	db := newTestDb(t)
+
+	if rw := serveKey(db, http.MethodPost, "key", nil, `{"value":"v"}`); rw.Code != http.StatusCreated {
+		t.Fatalf("Expected 201, got %d", rw.Code)
+	}
+	if rw := serveKey(db, http.MethodDelete, "key", nil, ""); rw.Code != http.StatusOK {
+		t.Errorf("Expected 200, got %d", rw.Code)
+	}
+	if rw := serveKey(db, http.MethodGet, "key", nil, ""); rw.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 after the delete, got %d", rw.Code)
+	}
+	if rw := serveKey(db, http.MethodDelete, "missing", nil, ""); rw.Code != http.StatusOK {
+		t.Errorf("Expected 200 for a missing key, got %d", rw.Code)
+	}
+	if rw := serveKey(db, http.MethodPut, "key", nil, `{"value":"v"}`); rw.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for an unknown method, got %d", rw.Code)
+	}
+}
+
+func TestTypedValues(t *testing.T) {
+	db := newTestDb(t)
+	serve := func(method, key, query, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, "/db/default/"+key+query, strings.NewReader(body))
+		rw := httptest.NewRecorder()
+		handleDBRequest(rw, req, key, db)
+		return rw
+	}
+
+	if rw := serve(http.MethodPost, "int", "?type=int64", `{"value":42}`); rw.Code != http.StatusCreated {
+		t.Fatalf("Expected 201, got %d", rw.Code)
+	}
+	rw := serve(http.MethodGet, "int", "?type=int64", "")
+	var body Int64RespBody
+	if err := json.NewDecoder(rw.Body).Decode(&body); err != nil || rw.Code != http.StatusOK || body.Value != 42 {
+		t.Errorf("Expected 42, got %d %+v (%v)", rw.Code, body, err)
+	}
+
+	data := "\x00data\xff"
+	if rw := serve(http.MethodPost, "bytes", "?type=bytes", data); rw.Code != http.StatusCreated {
+		t.Fatalf("Expected 201, got %d", rw.Code)
+	}
+	rw = serve(http.MethodGet, "bytes", "?type=bytes", "")
+	if rw.Code != http.StatusOK || rw.Body.String() != data {
+		t.Errorf("Expected the raw bytes, got %d %q", rw.Code, rw.Body.String())
+	}
+	if ct := rw.Header().Get("content-type"); ct != "application/octet-stream" {
+		t.Errorf("Expected application/octet-stream, got %s", ct)
+	}
+
+	cases := []struct {
+		name   string
+		method string
+		key    string
+		query  string
+		body   string
+		status int
+	}{
+		{"unknown type", http.MethodGet, "int", "?type=float", "", http.StatusBadRequest},
+		{"int64 read as a string", http.MethodGet, "int", "", "", http.StatusConflict},
+		{"bytes read as an int64", http.MethodGet, "bytes", "?type=int64", "", http.StatusConflict},
+		{"missing int64", http.MethodGet, "missing", "?type=int64", "", http.StatusNotFound},
+		{"bad int64", http.MethodPost, "int", "?type=int64", `{"value":"v"}`, http.StatusBadRequest},
+	}
+	for _, c := range cases {
+		if rw := serve(c.method, c.key, c.query, c.body); rw.Code != c.status {
+			t.Errorf("%s: expected %d, got %d", c.name, c.status, rw.Code)
+		}
+	}
+}
+
+func TestIncrement(t *testing.T) {
+	db := newTestDb(t)
+
+	cases := []struct {
+		name   string
+		key    string
+		body   string
+		status int
+		value  int64
+	}{
+		{"missing key", "counter" + incrSuffix, "", http.StatusOK, 1},
+		{"delta", "counter" + incrSuffix, `{"delta":5}`, http.StatusOK, 6},
+		{"negative delta", "counter" + incrSuffix, `{"delta":-10}`, http.StatusOK, -4},
+		{"bad body", "counter" + incrSuffix, `{"delta":"1"}`, http.StatusBadRequest, 0},
+		{"string value", "str" + incrSuffix, "", http.StatusConflict, 0},
+	}
+	if rw := serveKey(db, http.MethodPost, "str", nil, `{"value":"v"}`); rw.Code != http.StatusCreated {
+		t.Fatalf("Expected 201, got %d", rw.Code)
+	}
+	for _, c := range cases {
+		rw := serveKey(db, http.MethodPost, c.key, nil, c.body)
+		if rw.Code != c.status {
+			t.Errorf("%s: expected %d, got %d", c.name, c.status, rw.Code)
+			continue
+		}
+		if c.status != http.StatusOK {
+			continue
+		}
+		var body Int64RespBody
+		if err := json.NewDecoder(rw.Body).Decode(&body); err != nil || body.Value != c.value {
+			t.Errorf("%s: expected %d, got %+v (%v)", c.name, c.value, body, err)
+		}
+	}
+
+	if n, _ := db.GetInt64("counter"); n != -4 {
+		t.Errorf("Expected the counter to be -4, got %d", n)
+	}
+}
+
+func TestBatch(t *testing.T) {
+	db := newTestDb(t)
+	if rw := serveKey(db, http.MethodPost, "old", nil, `{"value":"v"}`); rw.Code != http.StatusCreated {
+		t.Fatalf("Expected 201, got %d", rw.Code)
+	}
+
+	cases := []struct {
+		name   string
+		body   string
+		status int
+	}{
+		{"unknown op", `[{"op":"put","key":"a","value":"1"},{"op":"incr","key":"b"}]`, http.StatusBadRequest},
+		{"missing op", `[{"key":"a","value":"1"}]`, http.StatusBadRequest},
+		{"bad body", `{"op":"put","key":"a","value":"1"}`, http.StatusBadRequest},
+	}
+	for _, c := range cases {
+		if rw := serveKey(db, http.MethodPost, batchKey, nil, c.body); rw.Code != c.status {
+			t.Errorf("%s: expected %d, got %d", c.name, c.status, rw.Code)
+		}
+	}
+	if _, err := db.Get("a"); err != datastore.ErrNotFound {
+		t.Errorf("Rejected batch was written: %v", err)
+	}
+
+	body := `[{"op":"put","key":"a","value":"1"},{"op":"put","key":"b","value":"2"},{"op":"delete","key":"old"}]`
+	if rw := serveKey(db, http.MethodPost, batchKey, nil, body); rw.Code != http.StatusCreated {
+		t.Fatalf("Expected 201, got %d", rw.Code)
+	}
+
+	for key, value := range map[string]string{"a": "1", "b": "2"} {
+		if got, err := db.Get(key); err != nil || got != value {
+			t.Errorf("Expected %s for %s, got %q (%v)", value, key, got, err)
+		}
+	}
+	if _, err := db.Get("old"); err != datastore.ErrNotFound {
+		t.Errorf("Expected old to be deleted, got %v", err)
+	}
+}
+
+func TestList(t *testing.T) {
+	db := newTestDb(t)
+	for i := 1; i <= 5; i++ {
+		if err := db.Put(fmt.Sprintf("user/%d", i), fmt.Sprintf("name%d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Put("group/1", "admins"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.PutInt64("user/count", 5); err != nil {
+		t.Fatal(err)
+	}
+	list := func(query string) (int, ListRespBody) {
+		req := httptest.NewRequest(http.MethodGet, "/db/default/"+query, nil)
+		rw := httptest.NewRecorder()
+		handleDBRequest(rw, req, "", db)
+		var body ListRespBody
+		if rw.Code == http.StatusOK {
+			if err := json.NewDecoder(rw.Body).Decode(&body); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return rw.Code, body
+	}
+
+	var pages []string
+	cursor := ""
+	for i := 0; i < 5; i++ {
+		status, body := list("?prefix=user/&limit=2&cursor=" + cursor)
+		if status != http.StatusOK {
+			t.Fatalf("Expected 200, got %d", status)
+		}
+		var page []string
+		for _, item := range body.Items {
+			page = append(page, item.Key+"="+item.Value+":"+item.Type)
+		}
+		pages = append(pages, strings.Join(page, ","))
+		if cursor = body.NextCursor; cursor == "" {
+			break
+		}
+	}
+	expected := "user/1=name1:string,user/2=name2:string|" +
+		"user/3=name3:string,user/4=name4:string|" +
+		"user/5=name5:string,user/count=5:int64"
+	if got := strings.Join(pages, "|"); got != expected {
+		t.Errorf("Expected pages %s, got %s", expected, got)
+	}
+
+	if status, body := list(""); status != http.StatusOK || len(body.Items) != 7 || body.NextCursor != "" {
+		t.Errorf("Expected all 7 keys on one page, got %d %+v", status, body)
+	}
+	for _, query := range []string{"?limit=0", "?limit=x", fmt.Sprintf("?limit=%d", maxListLimit+1)} {
+		if status, _ := list(query); status != http.StatusBadRequest {
+			t.Errorf("%s: expected 400, got %d", query, status)
+		}
+	}
+}
+
+func TestCompaction(t *testing.T) {
+	db, err := datastore.Open(t.TempDir(),
+		datastore.WithSegmentSize(100),
+		datastore.WithCompaction(datastore.CompactionPolicy{Disabled: true}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for i := 0; i < 10; i++ {
+		if err := db.Put("key", fmt.Sprintf("value%d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	serve := func(handler func(http.ResponseWriter, *http.Request, *datastore.Db), method, path string) (int, CompactionRespBody) {
+		rw := httptest.NewRecorder()
+		handler(rw, httptest.NewRequest(method, path, nil), db)
+		var body CompactionRespBody
+		if rw.Code == http.StatusOK {
+			if err := json.NewDecoder(rw.Body).Decode(&body); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return rw.Code, body
+	}
+
+	status, body := serve(handleCompactionStats, http.MethodGet, "/admin/compaction")
+	if status != http.StatusOK || body.Compactions != 0 || body.LastStarted != nil {
+		t.Errorf("Expected no compactions yet, got %d %+v", status, body)
+	}
+	status, body = serve(handleCompact, http.MethodPost, "/admin/compact")
+	if status != http.StatusOK || body.Compactions != 1 || body.Running || body.LastStarted == nil || body.LastBytesReclaimed <= 0 {
+		t.Errorf("Expected a finished compaction, got %d %+v", status, body)
+	}
+	if value, err := db.Get("key"); err != nil || value != "value9" {
+		t.Errorf("Expected value9, got %q (%v)", value, err)
+	}
+
+	if status, _ := serve(handleCompact, http.MethodGet, "/admin/compact"); status != http.StatusMethodNotAllowed {
+		t.Errorf("GET /admin/compact: expected 405, got %d", status)
+	}
+	if status, _ := serve(handleCompactionStats, http.MethodDelete, "/admin/compaction"); status != http.StatusMethodNotAllowed {
+		t.Errorf("DELETE /admin/compaction: expected 405, got %d", status)
+	}
+}
+
+func TestBackup(t *testing.T) {
+	db := newTestDb(t)
+	if err := db.Put("key", "value"); err != nil {
+		t.Fatal(err)
+	}
+
+	rw := httptest.NewRecorder()
+	handleBackup(rw, httptest.NewRequest(http.MethodGet, "/admin/backup", nil), db)
+	if rw.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d", rw.Code)
+	}
+	if ct := rw.Header().Get("content-type"); ct != "application/x-tar" {
+		t.Errorf("Expected application/x-tar, got %s", ct)
+	}
+
+	dir := t.TempDir()
+	if err := datastore.Restore(dir, rw.Body); err != nil {
+		t.Fatal(err)
+	}
+	restored, err := datastore.Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer restored.Close()
+	if value, err := restored.Get("key"); err != nil || value != "value" {
+		t.Errorf("Expected value in the restored store, got %q (%v)", value, err)
+	}
+
+	rw = httptest.NewRecorder()
+	handleBackup(rw, httptest.NewRequest(http.MethodPost, "/admin/backup", nil), db)
+	if rw.Code != http.StatusMethodNotAllowed {
+		t.Errorf("POST /admin/backup: expected 405, got %d", rw.Code)
+	}
+}
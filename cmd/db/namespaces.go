@@ -0,0 +1,394 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"sync"
+	"sync/atomic"
+
+	"github.com/yaryna-bashchak/kpi-architecture-lab-4/datastore"
+)
+
+// The default namespace keeps the root of the data directory, so stores
+// written before namespaces existed stay readable. Every other namespace has
+// a subdirectory of namespacesDir.
+const (
+	defaultNamespace    = "default"
+	namespacesDir       = "namespaces"
+	namespaceConfigName = "namespace.json"
+)
+
+var namespaceName = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{0,63}$`)
+
+var (
+	errBadNamespace      = errors.New("namespace names are lowercase letters, digits, '-' and '_'")
+	errNamespaceNotFound = errors.New("namespace not found")
+	errNamespaceDropping = errors.New("namespace is being dropped")
+	errDropDefault       = errors.New("the default namespace cannot be dropped")
+	errSegmentSizeFixed  = errors.New("the segment size of a namespace cannot change")
+	errQuotaExceeded     = errors.New("namespace quota exceeded")
+)
+
+// NamespaceConfig is the body of PUT /admin/namespaces/<name>. A zero
+// segment size takes the one of the server and a zero MaxBytes sets no quota.
+type NamespaceConfig struct {
+	SegmentSize int64 `json:"segment_size,omitempty"`
+	MaxBytes    int64 `json:"max_bytes,omitempty"`
+}
+
+// NamespaceInfo is an item of the response of GET /admin/namespaces.
+type NamespaceInfo struct {
+	Name string `json:"name"`
+	NamespaceConfig
+	Size    int64 `json:"size"`
+	Version int64 `json:"version"`
+}
+
+// namespace is an open store of a namespace.
+type namespace struct {
+	name     string
+	dir      string
+	db       *datastore.Db
+	maxBytes atomic.Int64
+	// users counts the requests that use the store; it is closed once they
+	// are done. dropped cancels the long running ones.
+	users   sync.WaitGroup
+	dropped context.Context
+	drop    context.CancelFunc
+	// dropping is set, under the lock of the namespaces, while the files of
+	// the namespace are removed. The namespace can't be used or created
+	// again meanwhile.
+	dropping bool
+}
+
+// release ends a use of the namespace started by namespaces.acquire.
+func (ns *namespace) release() {
+	ns.users.Done()
+}
+
+// context returns a context of a request that is also cancelled once the
+// namespace is dropped.
+func (ns *namespace) context(parent context.Context) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(parent)
+	go func() {
+		select {
+		case <-ns.dropped.Done():
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, cancel
+}
+
+// checkQuota fails once the segment files of the namespace reach its quota.
+// Compaction gives the space of replaced records back.
+func (ns *namespace) checkQuota() error {
+	max := ns.maxBytes.Load()
+	if max <= 0 {
+		return nil
+	}
+	size, err := ns.db.Size()
+	if err != nil {
+		return err
+	}
+	if size >= max {
+		return fmt.Errorf("%w: %s takes %d of %d bytes", errQuotaExceeded, ns.name, size, max)
+	}
+	return nil
+}
+
+// namespaces holds the open namespaces of the server.
+type namespaces struct {
+	dir  string
+	opts []datastore.Option
+
+	mu  sync.Mutex
+	all map[string]*namespace
+}
+
+// openNamespaces opens the default namespace and every namespace found in
+// the data directory.
+func openNamespaces(dir string, opts ...datastore.Option) (*namespaces, error) {
+	n := &namespaces{dir: dir, opts: opts, all: make(map[string]*namespace)}
+	if _, err := n.open(defaultNamespace, nil); err != nil {
+		return nil, err
+	}
+	entries, err := os.ReadDir(filepath.Join(dir, namespacesDir))
+	if err != nil && !os.IsNotExist(err) {
+		n.close()
+		return nil, err
+	}
+	for _, e := range entries {
+		if !e.IsDir() || !namespaceName.MatchString(e.Name()) || e.Name() == defaultNamespace {
+			continue
+		}
+		if _, err := n.open(e.Name(), nil); err != nil {
+			n.close()
+			return nil, err
+		}
+	}
+	return n, nil
+}
+
+func (n *namespaces) path(name string) string {
+	if name == defaultNamespace {
+		return n.dir
+	}
+	return filepath.Join(n.dir, namespacesDir, name)
+}
+
+// open opens the store of the namespace and adds it. A nil config reads the
+// one saved with the store; otherwise the config is saved first.
+func (n *namespaces) open(name string, config *NamespaceConfig) (*namespace, error) {
+	dir := n.path(name)
+	_, statErr := os.Stat(dir)
+	created := os.IsNotExist(statErr)
+	if config == nil {
+		var err error
+		if config, err = readNamespaceConfig(dir); err != nil {
+			return nil, err
+		}
+	} else {
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			return nil, err
+		}
+		if err := writeNamespaceConfig(dir, *config); err != nil {
+			return nil, err
+		}
+	}
+
+	opts := append([]datastore.Option(nil), n.opts...)
+	if config.SegmentSize > 0 {
+		opts = append(opts, datastore.WithSegmentSize(config.SegmentSize))
+	}
+	db, err := datastore.Open(dir, opts...)
+	if err != nil {
+		if created {
+			os.RemoveAll(dir)
+		}
+		return nil, fmt.Errorf("cannot open namespace %s: %w", name, err)
+	}
+	report := db.RecoveryReport()
+	for _, bad := range report.BadRecords {
+		log.Printf("Repaired %s: dropped data after offset %d: %s", bad.Segment, bad.Offset, bad.Reason)
+	}
+	if !report.Clean() {
+		log.Printf("Repair of namespace %s dropped %d bytes", name, report.BytesDropped)
+	}
+	stats := db.Stats()
+	log.Printf("Opened namespace %s: recovered %d segments, %d keys", name, stats.Segments, stats.Keys)
+
+	ns := &namespace{name: name, dir: dir, db: db}
+	ns.maxBytes.Store(config.MaxBytes)
+	ns.dropped, ns.drop = context.WithCancel(context.Background())
+	n.all[name] = ns
+	return ns, nil
+}
+
+// acquire returns the namespace for a request, which must release it. A
+// missing namespace is created with the defaults if create is set.
+func (n *namespaces) acquire(name string, create bool) (*namespace, error) {
+	if !namespaceName.MatchString(name) {
+		return nil, errBadNamespace
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	ns, ok := n.all[name]
+	if ok && ns.dropping {
+		return nil, errNamespaceDropping
+	}
+	if !ok {
+		if !create {
+			return nil, errNamespaceNotFound
+		}
+		var err error
+		if ns, err = n.open(name, &NamespaceConfig{}); err != nil {
+			return nil, err
+		}
+	}
+	ns.users.Add(1)
+	return ns, nil
+}
+
+// put creates the namespace or updates its quota. The segment size is fixed
+// once the store exists.
+func (n *namespaces) put(name string, config NamespaceConfig) (created bool, err error) {
+	if !namespaceName.MatchString(name) {
+		return false, errBadNamespace
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	ns, ok := n.all[name]
+	if !ok {
+		_, err := n.open(name, &config)
+		return err == nil, err
+	}
+	if ns.dropping {
+		return false, errNamespaceDropping
+	}
+
+	current, err := readNamespaceConfig(ns.dir)
+	if err != nil {
+		return false, err
+	}
+	if config.SegmentSize != 0 && config.SegmentSize != current.SegmentSize {
+		return false, errSegmentSizeFixed
+	}
+	config.SegmentSize = current.SegmentSize
+	if err := writeNamespaceConfig(ns.dir, config); err != nil {
+		return false, err
+	}
+	ns.maxBytes.Store(config.MaxBytes)
+	return false, nil
+}
+
+// remove drops the namespace and removes its files once the requests that
+// use it are done. The namespace stays in the map, marked as dropping, until
+// its files are gone, so a write can't create it again before.
+func (n *namespaces) remove(name string) error {
+	if name == defaultNamespace {
+		return errDropDefault
+	}
+	n.mu.Lock()
+	ns, ok := n.all[name]
+	if !ok {
+		n.mu.Unlock()
+		return errNamespaceNotFound
+	}
+	if ns.dropping {
+		n.mu.Unlock()
+		return errNamespaceDropping
+	}
+	ns.dropping = true
+	n.mu.Unlock()
+
+	ns.drop()
+	ns.users.Wait()
+	if err := ns.db.Close(); err != nil {
+		log.Printf("Cannot close namespace %s: %s", name, err)
+	}
+	err := os.RemoveAll(ns.dir)
+
+	n.mu.Lock()
+	delete(n.all, name)
+	n.mu.Unlock()
+	return err
+}
+
+// reset replaces the store of the namespace with the one restore writes into
+// its emptied directory. Like remove, it marks the namespace as dropping until
+// the requests that use it are done and the store is open again. If restore
+// fails, the namespace is left empty.
+func (n *namespaces) reset(name string, restore func(dir string) error) error {
+	n.mu.Lock()
+	ns, ok := n.all[name]
+	if !ok {
+		n.mu.Unlock()
+		return errNamespaceNotFound
+	}
+	if ns.dropping {
+		n.mu.Unlock()
+		return errNamespaceDropping
+	}
+	ns.dropping = true
+	n.mu.Unlock()
+
+	ns.drop()
+	ns.users.Wait()
+	if err := ns.db.Close(); err != nil {
+		log.Printf("Cannot close namespace %s: %s", name, err)
+	}
+	err := datastore.RemoveStore(ns.dir)
+	if err == nil {
+		err = restore(ns.dir)
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	delete(n.all, name)
+	if _, openErr := n.open(name, nil); err == nil {
+		err = openErr
+	}
+	return err
+}
+
+// list describes the namespaces in the order of their names.
+func (n *namespaces) list() ([]NamespaceInfo, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	infos := make([]NamespaceInfo, 0, len(n.all))
+	for name, ns := range n.all {
+		if ns.dropping {
+			continue
+		}
+		config, err := readNamespaceConfig(ns.dir)
+		if err != nil {
+			return nil, err
+		}
+		size, err := ns.db.Size()
+		if err != nil {
+			return nil, err
+		}
+		infos = append(infos, NamespaceInfo{
+			Name:            name,
+			NamespaceConfig: *config,
+			Size:            size,
+			Version:         ns.db.Version(),
+		})
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Name < infos[j].Name })
+	return infos, nil
+}
+
+// close closes every namespace once the requests that use them are done.
+// The ones being dropped are closed by remove.
+func (n *namespaces) close() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	for name, ns := range n.all {
+		if ns.dropping {
+			continue
+		}
+		ns.drop()
+		ns.users.Wait()
+		if err := ns.db.Close(); err != nil {
+			log.Printf("Cannot close namespace %s: %s", name, err)
+		}
+	}
+	n.all = make(map[string]*namespace)
+}
+
+// readNamespaceConfig reads the config saved with the store. Stores without
+// one use the defaults.
+func readNamespaceConfig(dir string) (*NamespaceConfig, error) {
+	var config NamespaceConfig
+	data, err := os.ReadFile(filepath.Join(dir, namespaceConfigName))
+	if os.IsNotExist(err) {
+		return &config, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &config); err != nil {
+		return nil, fmt.Errorf("bad config of namespace in %s: %w", dir, err)
+	}
+	return &config, nil
+}
+
+func writeNamespaceConfig(dir string, config NamespaceConfig) error {
+	data, err := json.Marshal(config)
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(dir, namespaceConfigName)
+	if err := os.WriteFile(path+".tmp", data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// send makes a request to the test server and returns the response status.
+func send(t *testing.T, method, url, body string) int {
+	t.Helper()
+	req, err := http.NewRequest(method, url, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+func TestNamespaces(t *testing.T) {
+	spaces := newTestNamespaces(t)
+	ts := newTestServer(t, spaces, nil)
+
+	t.Run("created by writes", func(t *testing.T) {
+		if status := send(t, http.MethodGet, ts.URL+"/db/lazy/key", ""); status != http.StatusNotFound {
+			t.Errorf("Expected 404 from a missing namespace, got %d", status)
+		}
+		if status := send(t, http.MethodDelete, ts.URL+"/db/lazy/key", ""); status != http.StatusNotFound {
+			t.Errorf("Expected 404 for a delete from a missing namespace, got %d", status)
+		}
+		if status := send(t, http.MethodPost, ts.URL+"/db/lazy/", `{"value":"v"}`); status != http.StatusBadRequest {
+			t.Errorf("Expected 400 for a write without a key, got %d", status)
+		}
+		if _, err := os.Stat(spaces.path("lazy")); !os.IsNotExist(err) {
+			t.Fatalf("Namespace was created by a request that can't write: %v", err)
+		}
+
+		if status := send(t, http.MethodPost, ts.URL+"/db/lazy/key", `{"value":"v"}`); status != http.StatusCreated {
+			t.Fatalf("Expected 201, got %d", status)
+		}
+		if status := send(t, http.MethodGet, ts.URL+"/db/lazy/key", ""); status != http.StatusOK {
+			t.Errorf("Expected 200, got %d", status)
+		}
+		if status := send(t, http.MethodGet, ts.URL+"/db/default/key", ""); status != http.StatusNotFound {
+			t.Errorf("Key of another namespace found in the default one: %d", status)
+		}
+		if status := send(t, http.MethodPost, ts.URL+"/db/Bad/key", `{"value":"v"}`); status != http.StatusBadRequest {
+			t.Errorf("Expected 400 for a bad namespace name, got %d", status)
+		}
+	})
+
+	t.Run("quota", func(t *testing.T) {
+		if status := send(t, http.MethodPut, ts.URL+"/admin/namespaces/quota", `{"max_bytes":200}`); status != http.StatusCreated {
+			t.Fatalf("Expected 201, got %d", status)
+		}
+		status := http.StatusCreated
+		for i := 0; i < 20 && status == http.StatusCreated; i++ {
+			status = send(t, http.MethodPost, fmt.Sprintf("%s/db/quota/key%d", ts.URL, i), `{"value":"value"}`)
+		}
+		if status != http.StatusInsufficientStorage {
+			t.Fatalf("Expected 507 once the quota is used, got %d", status)
+		}
+		if status := send(t, http.MethodGet, ts.URL+"/db/quota/key0", ""); status != http.StatusOK {
+			t.Errorf("Expected reads over the quota to work, got %d", status)
+		}
+		if status := send(t, http.MethodPut, ts.URL+"/admin/namespaces/quota", `{"max_bytes":0}`); status != http.StatusOK {
+			t.Fatalf("Expected 200, got %d", status)
+		}
+		if status := send(t, http.MethodPost, ts.URL+"/db/quota/more", `{"value":"value"}`); status != http.StatusCreated {
+			t.Errorf("Expected 201 without a quota, got %d", status)
+		}
+	})
+
+	t.Run("fixed segment size", func(t *testing.T) {
+		url := ts.URL + "/admin/namespaces/fixed"
+		if status := send(t, http.MethodPut, url, `{"segment_size":1000}`); status != http.StatusCreated {
+			t.Fatalf("Expected 201, got %d", status)
+		}
+		if status := send(t, http.MethodPut, url, `{"segment_size":2000}`); status != http.StatusConflict {
+			t.Errorf("Expected 409 for a new segment size, got %d", status)
+		}
+		if status := send(t, http.MethodPut, url, `{"segment_size":1000,"max_bytes":5000}`); status != http.StatusOK {
+			t.Errorf("Expected 200 for the same segment size, got %d", status)
+		}
+	})
+
+	t.Run("drop", func(t *testing.T) {
+		if status := send(t, http.MethodPost, ts.URL+"/db/dropped/key", `{"value":"v"}`); status != http.StatusCreated {
+			t.Fatalf("Expected 201, got %d", status)
+		}
+		if status := send(t, http.MethodDelete, ts.URL+"/admin/namespaces/dropped", ""); status != http.StatusOK {
+			t.Fatalf("Expected 200, got %d", status)
+		}
+		if _, err := os.Stat(spaces.path("dropped")); !os.IsNotExist(err) {
+			t.Errorf("Files of the dropped namespace are left: %v", err)
+		}
+		if status := send(t, http.MethodGet, ts.URL+"/db/dropped/key", ""); status != http.StatusNotFound {
+			t.Errorf("Expected 404 after the drop, got %d", status)
+		}
+		if status := send(t, http.MethodDelete, ts.URL+"/admin/namespaces/default", ""); status != http.StatusConflict {
+			t.Errorf("Expected 409 for the default namespace, got %d", status)
+		}
+	})
+
+	t.Run("drop during a request", func(t *testing.T) {
+		if status := send(t, http.MethodPost, ts.URL+"/db/busy/key", `{"value":"v"}`); status != http.StatusCreated {
+			t.Fatalf("Expected 201, got %d", status)
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, ts.URL+"/db/busy/"+watchKey, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+
+		// The change feed uses the namespace until the drop ends it.
+		dropped := make(chan int, 1)
+		go func() {
+			req, _ := http.NewRequest(http.MethodDelete, ts.URL+"/admin/namespaces/busy", nil)
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				dropped <- 0
+				return
+			}
+			resp.Body.Close()
+			dropped <- resp.StatusCode
+		}()
+		if _, err := io.Copy(io.Discard, bufio.NewReader(resp.Body)); err != nil {
+			t.Errorf("Change feed failed instead of ending: %s", err)
+		}
+		select {
+		case status := <-dropped:
+			if status != http.StatusOK {
+				t.Errorf("Expected 200, got %d", status)
+			}
+		case <-ctx.Done():
+			t.Fatal("Drop did not finish")
+		}
+		if status := send(t, http.MethodGet, ts.URL+"/db/busy/key", ""); status != http.StatusNotFound {
+			t.Errorf("Expected 404 after the drop, got %d", status)
+		}
+	})
+}
+
+func TestFollower_Namespaces(t *testing.T) {
+	leader := newTestNamespaces(t)
+	ts := newTestServer(t, leader, nil)
+	follower := newTestNamespaces(t)
+	r := newReplicator(ts.URL, follower)
+	fs := newTestServer(t, follower, r)
+	r.start()
+	defer r.stop()
+
+	if status := send(t, http.MethodPost, ts.URL+"/db/orders/key", `{"value":"v"}`); status != http.StatusCreated {
+		t.Fatalf("Expected 201, got %d", status)
+	}
+	waitFor(t, "the follower to add the namespace", func() bool {
+		db := namespaceDb(follower, "orders")
+		if db == nil {
+			return false
+		}
+		value, err := db.Get("key")
+		return err == nil && value == "v"
+	})
+	if status := send(t, http.MethodGet, fs.URL+"/admin/replication?namespace=orders", ""); status != http.StatusOK {
+		t.Errorf("Expected the follower to report the namespace, got %d", status)
+	}
+
+	// Status requests wait for r.mu while the follower drops the namespace.
+	stop, stopped := make(chan struct{}), make(chan struct{})
+	defer func() {
+		close(stop)
+		<-stopped
+	}()
+	go func() {
+		defer close(stopped)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			if resp, err := http.Get(fs.URL + "/admin/replication?namespace=orders"); err == nil {
+				resp.Body.Close()
+			}
+		}
+	}()
+	if status := send(t, http.MethodDelete, ts.URL+"/admin/namespaces/orders", ""); status != http.StatusOK {
+		t.Fatalf("Expected 200, got %d", status)
+	}
+	waitFor(t, "the follower to drop the namespace", func() bool {
+		_, err := os.Stat(follower.path("orders"))
+		return namespaceDb(follower, "orders") == nil && os.IsNotExist(err)
+	})
+}
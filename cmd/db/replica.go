@@ -0,0 +1,463 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/yaryna-bashchak/kpi-architecture-lab-4/datastore"
+)
+
+const (
+	// retryInterval is the pause before a follower reconnects to its leader.
+	retryInterval = time.Second
+	// pollInterval is how often the namespaces and the versions of the
+	// leader are checked.
+	pollInterval = time.Second
+)
+
+// errFeedCompacted tells that the leader compacted writes the follower has
+// not applied yet, so they can't be replayed.
+var errFeedCompacted = errors.New("leader compacted the writes to replay")
+
+// replicator follows every namespace of the leader. It creates the
+// namespaces the leader has, drops the ones it dropped and runs a follower
+// for each.
+type replicator struct {
+	leader string
+	spaces *namespaces
+	// feed has no timeout as change feeds never end.
+	feed   *http.Client
+	client *http.Client
+	cancel context.CancelFunc
+	done   sync.WaitGroup
+
+	mu        sync.Mutex
+	followers map[string]*follower
+	lastError string
+}
+
+func newReplicator(leader string, spaces *namespaces) *replicator {
+	return &replicator{
+		leader:    leader,
+		spaces:    spaces,
+		feed:      &http.Client{},
+		client:    &http.Client{Timeout: 3 * time.Second},
+		followers: make(map[string]*follower),
+	}
+}
+
+func (r *replicator) start() {
+	ctx, cancel := context.WithCancel(context.Background())
+	r.cancel = cancel
+	r.done.Add(1)
+	go func() {
+		defer r.done.Done()
+		ticker := time.NewTicker(pollInterval)
+		defer ticker.Stop()
+		for {
+			err := r.sync(ctx)
+			if ctx.Err() != nil {
+				return
+			}
+			r.logError(err)
+			select {
+			case <-ticker.C:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+// stop disconnects from the leader and waits until no more writes are
+// applied, so the namespaces can be closed.
+func (r *replicator) stop() {
+	r.cancel()
+	r.done.Wait()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for name, f := range r.followers {
+		f.stop()
+		delete(r.followers, name)
+	}
+}
+
+// logError logs failures to reach the leader once, not on every poll.
+func (r *replicator) logError(err error) {
+	message := ""
+	if err != nil {
+		message = err.Error()
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if message != r.lastError && message != "" {
+		log.Printf("Cannot get the namespaces of %s: %s", r.leader, message)
+	}
+	r.lastError = message
+}
+
+// sync matches the namespaces and the followers to the namespaces of the
+// leader and passes the versions of the leader to the followers.
+func (r *replicator) sync(ctx context.Context) error {
+	infos, err := r.namespaces(ctx)
+	if err != nil {
+		return err
+	}
+	r.mu.Lock()
+	listed := make(map[string]struct{})
+	for _, info := range infos {
+		listed[info.Name] = struct{}{}
+		f, ok := r.followers[info.Name]
+		if !ok {
+			if _, err := r.spaces.put(info.Name, info.NamespaceConfig); err != nil {
+				log.Printf("Cannot follow namespace %s: %s", info.Name, err)
+				continue
+			}
+			f = newFollower(r.leader, info.Name, r.spaces, r.feed)
+			f.start()
+			r.followers[info.Name] = f
+			log.Printf("Following namespace %s of %s", info.Name, r.leader)
+		}
+		f.setLeaderVersion(info.Version)
+	}
+
+	dropped := make(map[string]*follower)
+	for name, f := range r.followers {
+		if _, ok := listed[name]; ok || name == defaultNamespace {
+			continue
+		}
+		dropped[name] = f
+		delete(r.followers, name)
+	}
+	r.mu.Unlock()
+
+	// Dropping waits for the requests that use the namespace, and a status
+	// request needs r.mu, so it is held no longer.
+	for name, f := range dropped {
+		f.stop()
+		if err := r.spaces.remove(name); err != nil {
+			log.Printf("Cannot drop namespace %s: %s", name, err)
+			continue
+		}
+		log.Printf("Dropped namespace %s like %s did", name, r.leader)
+	}
+	return nil
+}
+
+func (r *replicator) namespaces(ctx context.Context) ([]NamespaceInfo, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, r.leader+"/admin/namespaces", nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("leader answered %s", resp.Status)
+	}
+	var infos []NamespaceInfo
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&infos); err != nil {
+		return nil, err
+	}
+	return infos, nil
+}
+
+// status reports the replication of the namespace, if it is followed.
+func (r *replicator) status(name string) (ReplicationRespBody, bool) {
+	r.mu.Lock()
+	f, ok := r.followers[name]
+	r.mu.Unlock()
+	if !ok {
+		return ReplicationRespBody{}, false
+	}
+	return f.status(), true
+}
+
+// follower tails the change feed of a namespace of the leader and applies
+// its writes to the local namespace, keeping the sequence numbers of the
+// leader. After a restart it resumes from the last applied write.
+//
+// A follower that was down while the leader compacted the writes it had not
+// applied yet can't replay them, as compaction drops replaced records and
+// tombstones. The leader answers 410 then and the follower replaces the
+// namespace with a backup of the leader.
+type follower struct {
+	leader string
+	name   string
+	spaces *namespaces
+	feed   *http.Client
+	cancel context.CancelFunc
+	done   sync.WaitGroup
+	// applied is the version of the namespace as of the last write applied.
+	applied atomic.Int64
+
+	mu            sync.Mutex
+	connected     bool
+	leaderVersion int64
+	lastContact   time.Time
+	caughtUp      time.Time
+	lastError     string
+}
+
+// newFollower returns a follower of the namespace, which it acquires for
+// every connection to the leader, so the namespace can be dropped or reset
+// in between.
+func newFollower(leader, name string, spaces *namespaces, feed *http.Client) *follower {
+	return &follower{
+		leader:   leader,
+		name:     name,
+		spaces:   spaces,
+		feed:     feed,
+		caughtUp: time.Now(),
+	}
+}
+
+func (f *follower) start() {
+	ctx, cancel := context.WithCancel(context.Background())
+	f.cancel = cancel
+	f.done.Add(1)
+	go func() {
+		defer f.done.Done()
+		f.tailLoop(ctx)
+	}()
+}
+
+// stop waits until no more writes are applied.
+func (f *follower) stop() {
+	f.cancel()
+	f.done.Wait()
+}
+
+func (f *follower) tailLoop(ctx context.Context) {
+	for {
+		err := f.tail(ctx)
+		if errors.Is(err, errFeedCompacted) && ctx.Err() == nil {
+			log.Printf("Restoring namespace %s from a backup of %s: %s", f.name, f.leader, err)
+			err = f.resync(ctx)
+		}
+		f.mu.Lock()
+		f.connected = false
+		if err != nil && ctx.Err() == nil {
+			f.lastError = err.Error()
+			log.Printf("Replication of %s from %s failed: %s", f.name, f.leader, err)
+		}
+		f.mu.Unlock()
+
+		select {
+		case <-time.After(retryInterval):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// tail applies the change feed of the leader until it ends or fails.
+func (f *follower) tail(ctx context.Context) error {
+	ns, err := f.spaces.acquire(f.name, false)
+	if err != nil {
+		return err
+	}
+	defer ns.release()
+	// Dropping or resetting the namespace ends the feed.
+	ctx, cancel := ns.context(ctx)
+	defer cancel()
+	f.applied.Store(ns.db.Version())
+
+	url := fmt.Sprintf("%s/db/%s/%s?from=%d", f.leader, f.name, watchKey, ns.db.Version())
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := f.feed.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusGone {
+		return errFeedCompacted
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("leader answered %s", resp.Status)
+	}
+
+	f.mu.Lock()
+	f.connected = true
+	f.lastError = ""
+	f.mu.Unlock()
+
+	in := bufio.NewReader(resp.Body)
+	var id, event, data string
+	for {
+		line, err := in.ReadString('\n')
+		if err != nil {
+			return err
+		}
+		f.touch()
+		line = strings.TrimSuffix(line, "\n")
+		field, value, _ := strings.Cut(line, ":")
+		value = strings.TrimPrefix(value, " ")
+		switch field {
+		case "":
+			if line != "" || event == "" {
+				// A comment, like the heartbeat, or an empty event.
+				continue
+			}
+			e, err := parseEvent(id, event, data)
+			if err != nil {
+				return err
+			}
+			if err := ns.db.Apply(e); err != nil {
+				return err
+			}
+			f.applied.Store(ns.db.Version())
+			id, event, data = "", "", ""
+		case "id":
+			id = value
+		case "event":
+			event = value
+		case "data":
+			data = value
+		}
+	}
+}
+
+// resync replaces the namespace with a backup of the leader. The backup is
+// downloaded first, so the namespace is only closed while it is restored.
+func (f *follower) resync(ctx context.Context) error {
+	archive, err := os.CreateTemp("", "backup-*.tar")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(archive.Name())
+	defer archive.Close()
+
+	url := fmt.Sprintf("%s/admin/backup?namespace=%s", f.leader, f.name)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := f.feed.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("leader answered %s to the backup request", resp.Status)
+	}
+	if _, err := io.Copy(archive, resp.Body); err != nil {
+		return err
+	}
+
+	err = f.spaces.reset(f.name, func(dir string) error {
+		if _, err := archive.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		return datastore.Restore(dir, archive)
+	})
+	if err != nil {
+		return err
+	}
+	log.Printf("Restored namespace %s from a backup of %s", f.name, f.leader)
+	return nil
+}
+
+// parseEvent turns an event of the change feed back into a write.
+func parseEvent(id, event, data string) (datastore.Event, error) {
+	var e datastore.Event
+	seq, err := strconv.ParseInt(id, 10, 64)
+	if err != nil {
+		return e, fmt.Errorf("bad event id %q", id)
+	}
+	var body WatchEvent
+	if err := json.Unmarshal([]byte(data), &body); err != nil {
+		return e, fmt.Errorf("bad data of event %d: %w", seq, err)
+	}
+	e.Seq, e.Key = seq, body.Key
+
+	switch event {
+	case datastore.EventDelete.String():
+		e.Type = datastore.EventDelete
+		return e, nil
+	case datastore.EventPut.String():
+	default:
+		return e, fmt.Errorf("unknown type of event %d: %q", seq, event)
+	}
+	e.Type = datastore.EventPut
+	if body.ExpiresAt != nil {
+		e.ExpiresAt = *body.ExpiresAt
+	}
+	switch body.Type {
+	case typeString:
+		e.Value, e.ValueType = body.Value, datastore.TypeString
+	case typeInt64:
+		value, err := strconv.ParseInt(body.Value, 10, 64)
+		if err != nil {
+			return e, fmt.Errorf("bad int64 value of event %d: %w", seq, err)
+		}
+		e.SetInt64(value)
+	case typeBytes:
+		value, err := base64.StdEncoding.DecodeString(body.Value)
+		if err != nil {
+			return e, fmt.Errorf("bad bytes value of event %d: %w", seq, err)
+		}
+		e.Value, e.ValueType = string(value), datastore.TypeBytes
+	default:
+		return e, fmt.Errorf("unknown value type of event %d: %q", seq, body.Type)
+	}
+	return e, nil
+}
+
+// setLeaderVersion records the version of the namespace on the leader.
+func (f *follower) setLeaderVersion(version int64) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.leaderVersion = version
+	f.lastContact = time.Now()
+	if f.applied.Load() >= version {
+		f.caughtUp = f.lastContact
+	}
+}
+
+// touch records that the leader was heard from.
+func (f *follower) touch() {
+	f.mu.Lock()
+	f.lastContact = time.Now()
+	f.mu.Unlock()
+}
+
+func (f *follower) status() ReplicationRespBody {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	body := ReplicationRespBody{
+		Role:          "follower",
+		Version:       f.applied.Load(),
+		Leader:        f.leader,
+		LeaderVersion: f.leaderVersion,
+		Connected:     f.connected,
+		LastError:     f.lastError,
+	}
+	if body.LeaderVersion > body.Version {
+		body.Lag = body.LeaderVersion - body.Version
+		body.LagMs = time.Since(f.caughtUp).Milliseconds()
+	}
+	if !f.lastContact.IsZero() {
+		lastContact := f.lastContact
+		body.LastContact = &lastContact
+	}
+	return body
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/yaryna-bashchak/kpi-architecture-lab-4/datastore"
+)
+
+// newTestNamespaces opens the namespaces of a temporary directory. They are
+// compacted only when a test asks for it.
+func newTestNamespaces(t *testing.T) *namespaces {
+	t.Helper()
+	spaces, err := openNamespaces(t.TempDir(),
+		datastore.WithSegmentSize(200),
+		datastore.WithCompaction(datastore.CompactionPolicy{Disabled: true}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(spaces.close)
+	return spaces
+}
+
+// newTestServer serves the namespaces, as a follower of r if it is set.
+func newTestServer(t *testing.T, spaces *namespaces, r *replicator) *httptest.Server {
+	t.Helper()
+	s := &server{ServeMux: http.NewServeMux()}
+	s.routes(spaces, r)
+	ts := httptest.NewServer(s)
+	t.Cleanup(ts.Close)
+	return ts
+}
+
+// namespaceDb returns the current store of the namespace, nil if there is
+// none.
+func namespaceDb(spaces *namespaces, name string) *datastore.Db {
+	ns, err := spaces.acquire(name, false)
+	if err != nil {
+		return nil
+	}
+	defer ns.release()
+	return ns.db
+}
+
+func waitFor(t *testing.T, what string, done func() bool) {
+	t.Helper()
+	for i := 0; i < 250; i++ {
+		if done() {
+			return
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	t.Fatalf("Timed out waiting for %s", what)
+}
+
+func TestFollower_Resync(t *testing.T) {
+	leader := newTestNamespaces(t)
+	ts := newTestServer(t, leader, nil)
+	db := namespaceDb(leader, defaultNamespace)
+	follower := newTestNamespaces(t)
+	caughtUp := func() bool {
+		return namespaceDb(follower, defaultNamespace).Version() == db.Version()
+	}
+
+	for i := 0; i < 5; i++ {
+		if err := db.Put(fmt.Sprintf("key%d", i), "value"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	r := newReplicator(ts.URL, follower)
+	r.start()
+	waitFor(t, "the follower to catch up", caughtUp)
+	r.stop()
+
+	// The delete and the overwrite are merged away while the follower is
+	// down, so the leader can't replay them.
+	if err := db.Delete("key1"); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		if err := db.Put("key2", fmt.Sprintf("new%d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Compact(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	r = newReplicator(ts.URL, follower)
+	r.start()
+	defer r.stop()
+	waitFor(t, "the follower to restore a backup", caughtUp)
+
+	restored := namespaceDb(follower, defaultNamespace)
+	if _, err := restored.Get("key1"); !errors.Is(err, datastore.ErrNotFound) {
+		t.Errorf("Expected key1 to be deleted, got %v", err)
+	}
+	if value, err := restored.Get("key2"); err != nil || value != "new9" {
+		t.Errorf("Expected new9 for key2, got %q (%v)", value, err)
+	}
+	if value, err := restored.Get("key4"); err != nil || value != "value" {
+		t.Errorf("Expected value for key4, got %q (%v)", value, err)
+	}
+}
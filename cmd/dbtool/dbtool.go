@@ -0,0 +1,320 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"text/tabwriter"
+	"time"
+
+	"github.com/yaryna-bashchak/kpi-architecture-lab-4/datastore"
+)
+
+const usage = `Usage: dbtool <command> [-dir data] [args]
+
+Commands:
+  dump [file...]  list records with offset, key, value size and checksum status
+  verify          check every record checksum and report corrupt ranges
+  stats           show live and dead bytes per segment
+  get <key>       print the newest value of the key
+`
+
+func main() {
+	log.SetFlags(0)
+	if len(os.Args) < 2 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+
+	cmd := os.Args[1]
+	fs := flag.NewFlagSet(cmd, flag.ExitOnError)
+	dir := fs.String("dir", "data", "directory with segment files")
+	fs.Usage = func() {
+		fmt.Fprint(os.Stderr, usage)
+	}
+	_ = fs.Parse(os.Args[2:])
+
+	var err error
+	switch cmd {
+	case "dump":
+		err = dump(*dir, fs.Args())
+	case "verify":
+		err = verify(*dir)
+	case "stats":
+		err = stats(*dir)
+	case "get":
+		if fs.NArg() != 1 {
+			fs.Usage()
+			os.Exit(2)
+		}
+		err = get(*dir, fs.Arg(0))
+	default:
+		fs.Usage()
+		os.Exit(2)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// segmentRecord is a record together with the segment it was read from.
+type segmentRecord struct {
+	*datastore.Record
+	segment string
+}
+
+// damage describes the part of a segment file that could not be read.
+type damage struct {
+	offset int64
+	size   int64
+	err    error
+}
+
+// readSegment calls fn for every record of the file. Reading stops at the
+// first record whose size is unknown, which is returned as damage.
+func readSegment(path string, fn func(r *datastore.Record)) (*damage, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	stat, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	r := datastore.NewRecordReader(f)
+	for {
+		rec, err := r.Next()
+		if err == io.EOF {
+			return nil, nil
+		}
+		if err != nil {
+			return &damage{offset: r.Offset(), size: stat.Size() - r.Offset(), err: err}, nil
+		}
+		fn(rec)
+	}
+}
+
+// committed reads all segments, oldest first, and calls fn for the records
+// that took effect: records of a batch are only passed once its commit
+// record is found, and commit records as well as the index and footer of
+// sorted segments are skipped. Damaged records end the segment like they do
+// when the store is opened.
+func committed(dir string, fn func(r segmentRecord)) error {
+	paths, err := datastore.SegmentFiles(dir)
+	if err != nil {
+		return err
+	}
+
+	for _, path := range paths {
+		var pending []segmentRecord
+		broken := false
+		_, err := readSegment(path, func(rec *datastore.Record) {
+			if broken || !rec.Intact {
+				broken = true
+				return
+			}
+			switch {
+			case rec.Index || rec.Footer:
+			case rec.Commit:
+				count, err := rec.Int64()
+				if err != nil || count > int64(len(pending)) {
+					broken = true
+					return
+				}
+				for _, p := range pending[len(pending)-int(count):] {
+					fn(p)
+				}
+				pending = pending[:0]
+			case rec.Batch:
+				pending = append(pending, segmentRecord{rec, path})
+			default:
+				pending = pending[:0]
+				fn(segmentRecord{rec, path})
+			}
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func dump(dir string, files []string) error {
+	if len(files) == 0 {
+		var err error
+		if files, err = datastore.SegmentFiles(dir); err != nil {
+			return err
+		}
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	defer w.Flush()
+	fmt.Fprintln(w, "SEGMENT\tOFFSET\tSIZE\tKEY\tTYPE\tVALUE SIZE\tFLAGS\tCHECKSUM")
+	for _, path := range files {
+		name := filepath.Base(path)
+		bad, err := readSegment(path, func(rec *datastore.Record) {
+			status := "ok"
+			if !rec.Intact {
+				status = "BAD"
+			}
+			vtype := "-"
+			if !rec.Deleted {
+				vtype = rec.Type.String()
+			}
+			fmt.Fprintf(w, "%s\t%d\t%d\t%q\t%s\t%d\t%s\t%s\n",
+				name, rec.Offset, rec.Size, rec.Key, vtype, len(rec.Value), flags(rec), status)
+		})
+		if err != nil {
+			return err
+		}
+		if bad != nil {
+			fmt.Fprintf(w, "%s\t%d\t%d\t\t\t\t\tBAD: %s\n", name, bad.offset, bad.size, bad.err)
+		}
+	}
+	return nil
+}
+
+func flags(rec *datastore.Record) string {
+	switch {
+	case rec.Commit:
+		return "commit"
+	case rec.Index:
+		return "index"
+	case rec.Footer:
+		return "footer"
+	case rec.Batch && rec.Deleted:
+		return "batch,deleted"
+	case rec.Batch:
+		return "batch"
+	case rec.Deleted:
+		return "deleted"
+	default:
+		return "-"
+	}
+}
+
+var errCorrupted = errors.New("corrupted records found")
+
+func verify(dir string) error {
+	paths, err := datastore.SegmentFiles(dir)
+	if err != nil {
+		return err
+	}
+
+	corrupted := false
+	for _, path := range paths {
+		records := 0
+		bad, err := readSegment(path, func(rec *datastore.Record) {
+			records++
+			if !rec.Intact {
+				corrupted = true
+				fmt.Printf("%s: bytes %d-%d: checksum mismatch for key %q\n", path, rec.Offset, rec.Offset+rec.Size, rec.Key)
+			}
+		})
+		if err != nil {
+			return err
+		}
+		if bad != nil {
+			corrupted = true
+			fmt.Printf("%s: bytes %d-%d: %s\n", path, bad.offset, bad.offset+bad.size, bad.err)
+		}
+		fmt.Printf("%s: %d records checked\n", path, records)
+	}
+
+	if corrupted {
+		return errCorrupted
+	}
+	return nil
+}
+
+// segmentStats counts the bytes of a segment. Live bytes belong to the
+// newest version of existing keys; everything else is reclaimed by
+// compaction.
+type segmentStats struct {
+	size int64
+	live int64
+}
+
+func stats(dir string) error {
+	paths, err := datastore.SegmentFiles(dir)
+	if err != nil {
+		return err
+	}
+
+	newest := make(map[string]segmentRecord)
+	err = committed(dir, func(r segmentRecord) {
+		newest[r.Key] = r
+	})
+	if err != nil {
+		return err
+	}
+
+	segments := make(map[string]*segmentStats)
+	for _, path := range paths {
+		stat, err := os.Stat(path)
+		if err != nil {
+			return err
+		}
+		segments[path] = &segmentStats{size: stat.Size()}
+	}
+	for _, r := range newest {
+		if !r.Deleted {
+			segments[r.segment].live += r.Size
+		}
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', tabwriter.AlignRight)
+	defer w.Flush()
+	fmt.Fprintln(w, "SEGMENT\tSIZE\tLIVE\tDEAD\tDEAD %\t")
+	for _, path := range paths {
+		s := segments[path]
+		dead := s.size - s.live
+		ratio := 0.0
+		if s.size > 0 {
+			ratio = float64(dead) * 100 / float64(s.size)
+		}
+		fmt.Fprintf(w, "%s\t%d\t%d\t%d\t%.1f\t\n", filepath.Base(path), s.size, s.live, dead, ratio)
+	}
+	return nil
+}
+
+// expired tells whether a record written with a TTL has expired.
+func expired(rec *datastore.Record) bool {
+	return !rec.ExpiresAt.IsZero() && !time.Now().Before(rec.ExpiresAt)
+}
+
+func get(dir, key string) error {
+	var found *segmentRecord
+	err := committed(dir, func(r segmentRecord) {
+		if r.Key == key {
+			found = &r
+		}
+	})
+	if err != nil {
+		return err
+	}
+	if found == nil || found.Deleted || expired(found.Record) {
+		return fmt.Errorf("%s: %w", key, datastore.ErrNotFound)
+	}
+
+	if found.Type == datastore.TypeInt64 {
+		value, err := found.Int64()
+		if err != nil {
+			return err
+		}
+		fmt.Println(value)
+		return nil
+	}
+	_, err = os.Stdout.Write(found.Value)
+	if err == nil && found.Type == datastore.TypeString {
+		fmt.Println()
+	}
+	return err
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/yaryna-bashchak/kpi-architecture-lab-4/shard"
+)
+
+const usage = `Usage: rebalance -from <nodes> -to <nodes> [-namespace N] [-replicas N] [-timeout D]
+
+Moves the keys whose owner differs between the two rings, for example after
+a db node was added to or removed from CONF_DB_NODES of the servers. Nodes are
+comma separated URLs like http://db:8083. Run it once the servers route
+through the new list of nodes.
+`
+
+var (
+	from      = flag.String("from", "", "nodes of the ring the keys are stored by")
+	to        = flag.String("to", "", "nodes of the ring to store the keys by")
+	namespace = flag.String("namespace", "default", "namespace to move the keys of")
+	replicas  = flag.Int("replicas", shard.DefaultReplicas, "virtual nodes per node, as used by the servers")
+	timeout   = flag.Duration("timeout", 10*time.Second, "timeout of a single request to a node")
+)
+
+func main() {
+	log.SetFlags(0)
+	flag.Usage = func() {
+		fmt.Fprint(os.Stderr, usage)
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	oldNodes, newNodes := shard.ParseNodes(*from), shard.ParseNodes(*to)
+	if len(oldNodes) == 0 || len(newNodes) == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	client := &http.Client{Timeout: *timeout}
+	stats, err := shard.Rebalance(context.Background(), client, *namespace,
+		shard.NewRing(*replicas, oldNodes...), shard.NewRing(*replicas, newNodes...))
+	log.Printf("Scanned %d keys, moved %d", stats.Scanned, stats.Moved)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
@@ -12,6 +12,7 @@ import (
 	"time"
 
 	"github.com/yaryna-bashchak/kpi-architecture-lab-4/httptools"
+	"github.com/yaryna-bashchak/kpi-architecture-lab-4/shard"
 	"github.com/yaryna-bashchak/kpi-architecture-lab-4/signal"
 )
 
@@ -20,7 +21,12 @@ var port = flag.Int("port", 8080, "server port")
 
 const confResponseDelaySec = "CONF_RESPONSE_DELAY_SEC"
 const confHealthFailure = "CONF_HEALTH_FAILURE"
-const dbUrl = "http://db:8083/db"
+const confDbNodes = "CONF_DB_NODES"
+const confDbNamespace = "CONF_DB_NAMESPACE"
+
+// defaultDbNodes is used when CONF_DB_NODES, a comma separated list of db
+// node URLs, is not set.
+const defaultDbNodes = "http://db:8083"
 
 
 type ReqBody struct {
@@ -35,6 +41,15 @@ type RespBody struct {
 func main() {
 	h := new(http.ServeMux)
 	client := http.DefaultClient
+	nodes := os.Getenv(confDbNodes)
+	if nodes == "" {
+		nodes = defaultDbNodes
+	}
+	ring := shard.NewRing(shard.DefaultReplicas, shard.ParseNodes(nodes)...)
+	namespace := os.Getenv(confDbNamespace)
+	if namespace == "" {
+		namespace = "default"
+	}
 
 	h.HandleFunc("/health", func(rw http.ResponseWriter, r *http.Request) {
 		rw.Header().Set("content-type", "text/plain")
@@ -52,12 +67,12 @@ func main() {
 	h.HandleFunc("/api/v1/some-data", func(rw http.ResponseWriter, r *http.Request) {
 		key := r.URL.Query().Get("key")
 		if key != "" {
-			resp, err := client.Get(fmt.Sprintf("%s/%s", dbUrl, key))
-			statusOk := resp.StatusCode >= 200 && resp.StatusCode < 300
+			resp, err := client.Get(fmt.Sprintf("%s/db/%s/%s", ring.Node(key), namespace, key))
 			if err != nil {
 				rw.WriteHeader(http.StatusInternalServerError)
 				return
 			}
+			statusOk := resp.StatusCode >= 200 && resp.StatusCode < 300
 			if !statusOk {
 				rw.WriteHeader(resp.StatusCode)
 				return
@@ -110,7 +125,7 @@ func main() {
 	body := ReqBody{Value: time.Now().Format(time.RFC3339)}
 	json.NewEncoder(buff).Encode(body)
 
-	res, err := client.Post(fmt.Sprintf("%s/code-quartet", dbUrl), "application/json", buff)
+	res, err := client.Post(fmt.Sprintf("%s/db/%s/code-quartet", ring.Node("code-quartet"), namespace), "application/json", buff)
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -0,0 +1,202 @@
+package datastore
+
+import (
+	"archive/tar"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var ErrNotEmpty = errors.New("directory already holds a store")
+
+// Backup writes a tar archive of the segment files of a snapshot of the
+// store, oldest first. Writes and compactions go on while it runs. Bloom
+// filters and hints are left out, they are rebuilt as needed.
+func (db *Db) Backup(w io.Writer) error {
+	snap := db.Snapshot()
+	defer snap.Close()
+
+	tw := tar.NewWriter(w)
+	modTime := time.Now()
+	for i, s := range snap.held {
+		size := int64(-1)
+		if i == len(snap.held)-1 {
+			size = snap.end
+		}
+		if err := backupSegment(tw, s.filePath, size, db.fileMode, modTime); err != nil {
+			return err
+		}
+	}
+	return tw.Close()
+}
+
+// backupSegment adds the first size bytes of the segment file to the
+// archive, the whole file if size is negative.
+func backupSegment(tw *tar.Writer, path string, size int64, mode os.FileMode, modTime time.Time) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if size < 0 {
+		stat, err := f.Stat()
+		if err != nil {
+			return err
+		}
+		size = stat.Size()
+	}
+
+	err = tw.WriteHeader(&tar.Header{
+		Name:    filepath.Base(path),
+		Mode:    int64(mode),
+		Size:    size,
+		ModTime: modTime,
+	})
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(tw, io.NewSectionReader(f, 0, size))
+	return err
+}
+
+// Restore creates a store in dir from an archive written by Backup. The
+// directory is created if needed and must not hold a store already. The
+// restored files are removed if the archive can't be read in full.
+func Restore(dir string, r io.Reader) (err error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	lock, err := lockDir(dir, true, DefaultFileMode)
+	if err != nil {
+		return err
+	}
+	defer lock.Close()
+
+	files, err := segmentFiles(dir)
+	if err != nil {
+		return err
+	}
+	if _, err := os.Stat(filepath.Join(dir, manifestName)); len(files) > 0 || err == nil {
+		return fmt.Errorf("%w: %s", ErrNotEmpty, dir)
+	}
+
+	var segments []*Segment
+	var version int64
+	defer func() {
+		if err != nil {
+			for _, s := range segments {
+				s.removeFiles()
+			}
+		}
+	}()
+	tr := tar.NewReader(r)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if !isSegmentName(header.Name) || header.Typeflag != tar.TypeReg {
+			return fmt.Errorf("unexpected archive entry %q", header.Name)
+		}
+		s := newSegment(filepath.Join(dir, header.Name))
+		segments = append(segments, s)
+		if err := restoreFile(s.filePath, tr); err != nil {
+			return err
+		}
+		// Sorted segments are not scanned when the store is opened, so the
+		// versions they hold must be recorded in the manifest.
+		max, err := maxVersion(s.filePath)
+		if err != nil {
+			return err
+		}
+		if max > version {
+			version = max
+		}
+		s.version = max
+		// The manifest records what a compacted oldest segment merged.
+		if len(segments) == 1 {
+			if table, err := readSparseIndex(s.filePath); err == nil {
+				s.table = table
+			}
+		}
+	}
+	return writeManifest(dir, segments, version, DefaultFileMode)
+}
+
+// RemoveStore removes the files of the store in dir, which must not be open,
+// so that another one can be restored there. Other files in dir are kept.
+func RemoveStore(dir string) error {
+	lock, err := lockDir(dir, true, DefaultFileMode)
+	if err != nil {
+		return err
+	}
+	defer lock.Close()
+
+	files, err := segmentFiles(dir)
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		newSegment(filepath.Join(dir, file.name)).removeFiles()
+	}
+	if err := removeLeftovers(dir); err != nil {
+		return err
+	}
+	if err := os.Remove(filepath.Join(dir, manifestName)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return syncDir(dir)
+}
+
+// maxVersion returns the highest record version in the segment file.
+func maxVersion(path string) (int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	var max int64
+	r := NewRecordReader(f)
+	for {
+		rec, err := r.Next()
+		if err == io.EOF {
+			return max, nil
+		}
+		if err != nil {
+			return 0, err
+		}
+		if rec.Version > max {
+			max = rec.Version
+		}
+	}
+}
+
+func restoreFile(path string, r io.Reader) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, DefaultFileMode)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func isSegmentName(name string) bool {
+	index, err := strconv.Atoi(strings.TrimPrefix(name, outFileName))
+	return strings.HasPrefix(name, outFileName) && err == nil && index >= 0
+}
@@ -0,0 +1,169 @@
+package datastore
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDb_Snapshot(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := Open(dir, WithSegmentSize(150), WithCompaction(CompactionPolicy{Disabled: true}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	for i := 0; i < 10; i++ {
+		if err := db.Put(fmt.Sprintf("key%d", i), fmt.Sprintf("value%d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	snap := db.Snapshot()
+	defer snap.Close()
+
+	for i := 0; i < 10; i++ {
+		if err := db.Put(fmt.Sprintf("key%d", i), "changed"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Delete("key0"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put("new", "value"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Compact(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 10; i++ {
+		value, err := snap.Get(fmt.Sprintf("key%d", i))
+		if err != nil {
+			t.Fatalf("Cannot get key%d from the snapshot: %s", i, err)
+		}
+		assertEqual(t, value, fmt.Sprintf("value%d", i))
+	}
+	if _, err := snap.Get("new"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected ErrNotFound for a key written after the snapshot, got %v", err)
+	}
+
+	it := snap.Iterator("")
+	count := 0
+	for it.Next() {
+		assertEqual(t, it.Value(), fmt.Sprintf("value%d", count))
+		count++
+	}
+	if it.Err() != nil || count != 10 {
+		t.Errorf("Expected 10 keys in the snapshot, got %d (%v)", count, it.Err())
+	}
+}
+
+func TestDb_BackupRestore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDb(dir, 150)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	var b Batch
+	for i := 0; i < 10; i++ {
+		b.Put(fmt.Sprintf("key%d", i), fmt.Sprintf("value%d", i))
+	}
+	if err := db.Write(&b); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.PutInt64("counter", 42); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Delete("key5"); err != nil {
+		t.Fatal(err)
+	}
+
+	var archive bytes.Buffer
+	if err := db.Backup(&archive); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put("after", "backup"); err != nil {
+		t.Fatal(err)
+	}
+
+	restored := filepath.Join(dir, "restored")
+	if err := Restore(restored, bytes.NewReader(archive.Bytes())); err != nil {
+		t.Fatal(err)
+	}
+	rdb, err := NewDb(restored, 150)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rdb.Close()
+
+	for i := 0; i < 10; i++ {
+		value, err := rdb.Get(fmt.Sprintf("key%d", i))
+		if i == 5 {
+			if !errors.Is(err, ErrNotFound) {
+				t.Errorf("Expected key5 to stay deleted, got %v", err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		assertEqual(t, value, fmt.Sprintf("value%d", i))
+	}
+	if counter, err := rdb.GetInt64("counter"); err != nil || counter != 42 {
+		t.Errorf("Expected counter 42, got %d (%v)", counter, err)
+	}
+	if _, err := rdb.Get("after"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected ErrNotFound for a key written after the backup, got %v", err)
+	}
+
+	t.Run("refuses to overwrite a store", func(t *testing.T) {
+		rdb.Close()
+		if err := Restore(restored, bytes.NewReader(archive.Bytes())); !errors.Is(err, ErrNotEmpty) {
+			t.Errorf("Expected ErrNotEmpty, got %v", err)
+		}
+	})
+
+	t.Run("restores over a removed store", func(t *testing.T) {
+		other := filepath.Join(restored, "other")
+		if err := os.WriteFile(other, []byte("kept"), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		if err := RemoveStore(restored); err != nil {
+			t.Fatal(err)
+		}
+		if files, _ := segmentFiles(restored); len(files) != 0 {
+			t.Errorf("Segment files left: %v", files)
+		}
+		if _, err := os.Stat(other); err != nil {
+			t.Errorf("Other file removed: %s", err)
+		}
+		if err := Restore(restored, bytes.NewReader(archive.Bytes())); err != nil {
+			t.Fatal(err)
+		}
+		rdb, err := NewDb(restored, 150)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer rdb.Close()
+		value, _ := rdb.Get("key1")
+		assertEqual(t, value, "value1")
+	})
+}
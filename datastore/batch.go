@@ -0,0 +1,52 @@
+package datastore
+
+// Batch collects puts and deletes that are applied together by Db.Write.
+// The zero value is an empty batch ready to use.
+type Batch struct {
+	entries []entry
+}
+
+func (b *Batch) Put(key, value string) {
+	b.entries = append(b.entries, entry{
+		key:   key,
+		value: value,
+		vtype: TypeString,
+	})
+}
+
+func (b *Batch) Delete(key string) {
+	b.entries = append(b.entries, entry{
+		key:     key,
+		deleted: true,
+	})
+}
+
+func (b *Batch) Len() int {
+	return len(b.entries)
+}
+
+// Write atomically applies all operations of the batch. The records are
+// appended to the active segment with a single write followed by a commit
+// record; after a crash either the whole batch is recovered or none of it.
+func (db *Db) Write(b *Batch) error {
+	if b.Len() == 0 {
+		return nil
+	}
+
+	op := &writeOp{
+		entries: make([]entry, len(b.entries)),
+		batch:   true,
+		done:    make(chan error),
+	}
+	copy(op.entries, b.entries)
+	return db.submit(op)
+}
+
+// commitEntry is the record that closes a batch of count records.
+func commitEntry(count int) entry {
+	return entry{
+		value:  encodeInt64(int64(count)),
+		vtype:  TypeInt64,
+		commit: true,
+	}
+}
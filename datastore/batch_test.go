@@ -0,0 +1,97 @@
+package datastore
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestDb_Write(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDb(dir, 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	db.Put("key3", "value3")
+
+	t.Run("applies all operations", func(t *testing.T) {
+		var b Batch
+		b.Put("key1", "value1")
+		b.Put("key2", "value2")
+		b.Delete("key3")
+		if err := db.Write(&b); err != nil {
+			t.Fatal(err)
+		}
+
+		value, _ := db.Get("key1")
+		assertEqual(t, value, "value1")
+		value, _ = db.Get("key2")
+		assertEqual(t, value, "value2")
+		if _, err := db.Get("key3"); err != ErrNotFound {
+			t.Errorf("Expected ErrNotFound, got %v", err)
+		}
+	})
+
+	t.Run("ignores uncommitted batch on recovery", func(t *testing.T) {
+		if err := db.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		// Simulate a crash in the middle of a batch write: the records are
+		// on disk, but the commit record is not.
+		f, err := os.OpenFile(db.outPath, os.O_APPEND|os.O_WRONLY, 0o600)
+		if err != nil {
+			t.Fatal(err)
+		}
+		torn := []entry{
+			{key: "key1", value: "torn", vtype: TypeString, batched: true},
+			{key: "key4", value: "torn", vtype: TypeString, batched: true},
+		}
+		for _, e := range torn {
+			if _, err := f.Write(e.Encode()); err != nil {
+				t.Fatal(err)
+			}
+		}
+		f.Close()
+
+		db, err = NewDb(dir, 1000)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		value, _ := db.Get("key1")
+		assertEqual(t, value, "value1")
+		if _, err := db.Get("key4"); err != ErrNotFound {
+			t.Errorf("Expected ErrNotFound, got %v", err)
+		}
+	})
+
+	t.Run("later batches are not affected", func(t *testing.T) {
+		var b Batch
+		b.Put("key5", "value5")
+		if err := db.Write(&b); err != nil {
+			t.Fatal(err)
+		}
+		if err := db.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		db, err = NewDb(dir, 1000)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		value, _ := db.Get("key5")
+		assertEqual(t, value, "value5")
+		if _, err := db.Get("key4"); err != ErrNotFound {
+			t.Errorf("Expected ErrNotFound, got %v", err)
+		}
+	})
+}
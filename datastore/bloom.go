@@ -0,0 +1,110 @@
+package datastore
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"hash/fnv"
+	"os"
+)
+
+// Sorted segments get a Bloom filter stored in a file next to them, so that
+// lookups of missing keys can skip the segment without reading it.
+//
+// Filter file layout (all integers are little endian):
+//
+//	0   uint64 offset of the segment index record the filter belongs to
+//	8   uint32 number of hash functions
+//	12  filter bits
+//	    20 bytes of SHA1 sum of everything above
+const (
+	bloomSuffix       = ".bloom"
+	bloomBitsPerKey   = 10
+	bloomHashes       = 7
+	bloomHeaderSize   = 12
+	bloomMinSizeBytes = 8
+)
+
+var errBadBloom = errors.New("bad bloom filter file")
+
+type bloomFilter struct {
+	bits   []byte
+	hashes uint32
+}
+
+func newBloomFilter(keys int) *bloomFilter {
+	size := keys * bloomBitsPerKey / 8
+	if size < bloomMinSizeBytes {
+		size = bloomMinSizeBytes
+	}
+	return &bloomFilter{
+		bits:   make([]byte, size),
+		hashes: bloomHashes,
+	}
+}
+
+// locations derives the bit positions of the key from two halves of a
+// single 64-bit hash.
+func (f *bloomFilter) locations(key string, fn func(bit uint32)) {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	sum := h.Sum64()
+	h1, h2 := uint32(sum), uint32(sum>>32)
+	n := uint32(len(f.bits) * 8)
+	for i := uint32(0); i < f.hashes; i++ {
+		fn((h1 + i*h2) % n)
+	}
+}
+
+func (f *bloomFilter) add(key string) {
+	f.locations(key, func(bit uint32) {
+		f.bits[bit/8] |= 1 << (bit % 8)
+	})
+}
+
+// mayContain returns false only if the key was never added.
+func (f *bloomFilter) mayContain(key string) bool {
+	found := true
+	f.locations(key, func(bit uint32) {
+		if f.bits[bit/8]&(1<<(bit%8)) == 0 {
+			found = false
+		}
+	})
+	return found
+}
+
+// writeBloomFilter stores the filter of the sorted segment that ends its
+// records at end.
+func writeBloomFilter(path string, f *bloomFilter, end int64, perm os.FileMode) error {
+	data := make([]byte, bloomHeaderSize, bloomHeaderSize+len(f.bits)+sumSize)
+	binary.LittleEndian.PutUint64(data, uint64(end))
+	binary.LittleEndian.PutUint32(data[8:], f.hashes)
+	data = append(data, f.bits...)
+	sum := sha1.Sum(data)
+	data = append(data, sum[:]...)
+	return os.WriteFile(path, data, perm)
+}
+
+// readBloomFilter loads the filter stored for a sorted segment. A filter
+// written for another segment under the same name is rejected.
+func readBloomFilter(path string, end int64) (*bloomFilter, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < bloomHeaderSize+bloomMinSizeBytes+sumSize {
+		return nil, errBadBloom
+	}
+	sum := sha1.Sum(data[:len(data)-sumSize])
+	if !bytes.Equal(sum[:], data[len(data)-sumSize:]) {
+		return nil, errBadBloom
+	}
+	if int64(binary.LittleEndian.Uint64(data)) != end {
+		return nil, errBadBloom
+	}
+	return &bloomFilter{
+		bits:   data[bloomHeaderSize : len(data)-sumSize],
+		hashes: binary.LittleEndian.Uint32(data[8:]),
+	}, nil
+}
@@ -0,0 +1,98 @@
+package datastore
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestBloomFilter(t *testing.T) {
+	f := newBloomFilter(1000)
+	for i := 0; i < 1000; i++ {
+		f.add(fmt.Sprintf("key%d", i))
+	}
+	for i := 0; i < 1000; i++ {
+		if !f.mayContain(fmt.Sprintf("key%d", i)) {
+			t.Fatalf("Filter lost key%d", i)
+		}
+	}
+
+	falsePositives := 0
+	for i := 0; i < 10000; i++ {
+		if f.mayContain(fmt.Sprintf("missing%d", i)) {
+			falsePositives++
+		}
+	}
+	if falsePositives > 300 {
+		t.Errorf("Too many false positives: %d of 10000", falsePositives)
+	}
+
+	t.Run("persistence", func(t *testing.T) {
+		dir, err := ioutil.TempDir("", "test-db")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+
+		path := filepath.Join(dir, outFileName+"0"+bloomSuffix)
+		if err := writeBloomFilter(path, f, 123, DefaultFileMode); err != nil {
+			t.Fatal(err)
+		}
+		loaded, err := readBloomFilter(path, 123)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !loaded.mayContain("key42") {
+			t.Error("Loaded filter lost key42")
+		}
+		if _, err := readBloomFilter(path, 124); err != errBadBloom {
+			t.Errorf("Expected errBadBloom for another segment, got %v", err)
+		}
+	})
+}
+
+func TestDb_BloomFilter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := Open(dir, WithSegmentSize(85), WithCompaction(CompactionPolicy{Disabled: true}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i <= 5; i++ {
+		db.Put(fmt.Sprintf("key%d", i), fmt.Sprintf("value%d", i))
+	}
+	if err := db.Compact(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	assertSegmentsCount(t, db, 2)
+	if db.segmentList()[0].filter == nil {
+		t.Fatal("Compacted segment has no filter")
+	}
+	db.Close()
+
+	db, err = Open(dir, WithSegmentSize(85), WithCompaction(CompactionPolicy{Disabled: true}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if db.segmentList()[0].filter == nil {
+		t.Fatal("Filter was not loaded on reopen")
+	}
+	for i := 1; i <= 5; i++ {
+		value, err := db.Get(fmt.Sprintf("key%d", i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		assertEqual(t, value, fmt.Sprintf("value%d", i))
+	}
+	if _, err := db.Get("missing"); err != ErrNotFound {
+		t.Errorf("Expected ErrNotFound, got %v", err)
+	}
+}
@@ -0,0 +1,401 @@
+package datastore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"time"
+)
+
+// DefaultMaxSegments is the segment count that starts a compaction when the
+// policy doesn't set one.
+const DefaultMaxSegments = 3
+
+var ErrClosed = errors.New("database is closed")
+
+// CompactionPolicy tells when sealed segments are merged in the background.
+// The zero value merges them once the store has DefaultMaxSegments segments.
+type CompactionPolicy struct {
+	// Disabled turns background compaction off. Db.Compact still works.
+	Disabled bool
+	// MaxSegments starts a compaction once the store has that many
+	// segments, the active one included. Zero means DefaultMaxSegments and
+	// a negative value turns the check off.
+	MaxSegments int
+	// DeadRatio starts a compaction once this share of the bytes of sealed
+	// segments is taken by overwritten or deleted records. Zero turns the
+	// check off.
+	DeadRatio float64
+	// Interval merges the sealed segments periodically. Zero turns it off.
+	Interval time.Duration
+}
+
+func (p CompactionPolicy) validate() error {
+	if p.DeadRatio < 0 || p.DeadRatio >= 1 {
+		return &OptionError{"compaction dead ratio", fmt.Sprintf("must be in [0, 1), got %g", p.DeadRatio)}
+	}
+	if p.Interval < 0 {
+		return &OptionError{"compaction interval", fmt.Sprintf("must not be negative, got %s", p.Interval)}
+	}
+	return nil
+}
+
+func (p CompactionPolicy) maxSegments() int {
+	if p.MaxSegments == 0 {
+		return DefaultMaxSegments
+	}
+	return p.MaxSegments
+}
+
+// CompactionStats describes the running and the completed compactions.
+type CompactionStats struct {
+	Running bool
+	// Progress is the share of keys the running compaction has written.
+	Progress    float64
+	Compactions int
+	// LastStarted, LastDuration and LastBytesReclaimed describe the last
+	// completed compaction, LastError the last failed one.
+	LastStarted         time.Time
+	LastDuration        time.Duration
+	LastBytesReclaimed  int64
+	TotalBytesReclaimed int64
+	LastError           string
+}
+
+func (db *Db) CompactionStats() CompactionStats {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	return db.compaction
+}
+
+// compactOp is a request of Db.Compact.
+type compactOp struct {
+	ctx  context.Context
+	done chan error
+}
+
+// Compact merges all sealed segments into one and blocks until the merge
+// finishes. If ctx is done first, the merge is abandoned.
+func (db *Db) Compact(ctx context.Context) error {
+	if db.readOnly {
+		return ErrReadOnly
+	}
+	op := compactOp{ctx: ctx, done: make(chan error, 1)}
+	select {
+	case db.compactOps <- op:
+	case <-db.closing:
+		return ErrClosed
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	return <-op.done
+}
+
+// startCompactionRoutine runs the compactions of the store, one at a time.
+// It is woken up when a segment is sealed, by the policy interval and by
+// Db.Compact.
+func (db *Db) startCompactionRoutine() {
+	db.compactions.Add(1)
+	go func() {
+		defer db.compactions.Done()
+
+		var tick <-chan time.Time
+		if !db.policy.Disabled && db.policy.Interval > 0 {
+			ticker := time.NewTicker(db.policy.Interval)
+			defer ticker.Stop()
+			tick = ticker.C
+		}
+
+		for {
+			select {
+			case <-db.sealed:
+				for !db.policy.Disabled && db.hasSealedWork() && db.needsCompaction() {
+					if err := db.compact(context.Background()); err != nil {
+						db.logger.Printf("Compaction of %s failed: %s", db.dir, err)
+						break
+					}
+				}
+			case <-tick:
+				if db.hasSealedWork() {
+					if err := db.compact(context.Background()); err != nil {
+						db.logger.Printf("Compaction of %s failed: %s", db.dir, err)
+					}
+				}
+			case op := <-db.compactOps:
+				var err error
+				if db.hasSealedWork() {
+					err = db.compact(op.ctx)
+				}
+				op.done <- err
+			case <-db.closing:
+				return
+			}
+		}
+	}()
+}
+
+// notifySealed wakes up the compaction routine after a segment is sealed.
+func (db *Db) notifySealed() {
+	select {
+	case db.sealed <- struct{}{}:
+	default:
+	}
+}
+
+// needsCompaction evaluates the policy triggers that depend on the segments.
+func (db *Db) needsCompaction() bool {
+	segments := db.segmentList()
+	if max := db.policy.maxSegments(); max > 0 && len(segments) >= max {
+		return true
+	}
+	if db.policy.DeadRatio > 0 && len(segments) > 1 {
+		dead, total, err := db.deadBytes()
+		if err != nil {
+			db.logger.Printf("Cannot count dead bytes of %s: %s", db.dir, err)
+			return false
+		}
+		return total > 0 && float64(dead)/float64(total) >= db.policy.DeadRatio
+	}
+	return false
+}
+
+// hasSealedWork tells whether merging the sealed segments would change
+// anything.
+func (db *Db) hasSealedWork() bool {
+	segments := db.segmentList()
+	sealed := segments[:len(segments)-1]
+	return len(sealed) > 1 || len(sealed) == 1 && sealed[0].table == nil
+}
+
+// deadBytes counts the bytes of sealed segments that hold overwritten or
+// deleted records, and the total size of sealed segments. Records replaced
+// in the active segment are not counted, merging the sealed segments can't
+// drop them.
+func (db *Db) deadBytes() (dead, total int64, err error) {
+	segments := db.acquireSegments()
+	defer releaseSegments(segments)
+
+	sealed := segments[:len(segments)-1]
+	seen := make(map[string]struct{})
+	for i := range sealed {
+		s := sealed[len(sealed)-i-1]
+		f, err := os.Open(s.filePath)
+		if err != nil {
+			return 0, 0, err
+		}
+		var live int64
+		var sizeErr error
+		err = s.each(func(key string, position int64, deleted bool) {
+			if _, ok := seen[key]; ok {
+				return
+			}
+			seen[key] = struct{}{}
+			if deleted || sizeErr != nil {
+				return
+			}
+			size, err := recordSize(f, position)
+			if err != nil {
+				sizeErr = err
+			}
+			live += size
+		})
+		if err == nil {
+			err = sizeErr
+		}
+		if err == nil {
+			var stat os.FileInfo
+			if stat, err = f.Stat(); err == nil {
+				if s.table != nil {
+					// The sparse index and the footer are not dead.
+					live += stat.Size() - s.table.end
+				}
+				total += stat.Size()
+				dead += stat.Size() - live
+			}
+		}
+		f.Close()
+		if err != nil {
+			return 0, 0, err
+		}
+	}
+	return dead, total, nil
+}
+
+// compact runs a compaction and records its outcome in the stats.
+func (db *Db) compact(ctx context.Context) error {
+	started := time.Now()
+	db.mu.Lock()
+	db.compaction.Running = true
+	db.compaction.Progress = 0
+	db.mu.Unlock()
+
+	reclaimed, err := db.compactOldSegments(ctx)
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.compaction.Running = false
+	db.compaction.Progress = 0
+	if err != nil {
+		db.compaction.LastError = err.Error()
+		return err
+	}
+	db.compaction.Compactions++
+	db.compaction.LastStarted = started
+	db.compaction.LastDuration = time.Since(started)
+	db.compaction.LastBytesReclaimed = reclaimed
+	db.compaction.TotalBytesReclaimed += reclaimed
+	return nil
+}
+
+// compactOldSegments merges a snapshot of the sealed segments into a sorted
+// segment and returns the number of bytes it saved. Sealed segments never
+// change, so writes go on meanwhile. The result is synced and published in
+// the manifest in place of the merged segments, keeping every segment
+// created since the snapshot. The merged segments are then retired; their
+// files are removed once no reader uses them.
+func (db *Db) compactOldSegments(ctx context.Context) (int64, error) {
+	db.mu.Lock()
+	merged := append([]*Segment(nil), db.segments[:len(db.segments)-1]...)
+	db.mu.Unlock()
+	if len(merged) == 0 {
+		return 0, nil
+	}
+	// The manifest keeps the segment order, so the result gets a new name
+	// and the merged files stay intact for their readers.
+	filePath := db.getNewFileName()
+	tmpPath := filePath + compactSuffix
+
+	var mergedSize int64
+	positions := make(map[string]KeyPosition)
+	seen := make(map[string]struct{})
+	for i := range merged {
+		s := merged[len(merged)-i-1]
+		stat, err := os.Stat(s.filePath)
+		if err != nil {
+			return 0, err
+		}
+		mergedSize += stat.Size()
+
+		err = s.each(func(key string, position int64, deleted bool) {
+			if _, ok := seen[key]; ok {
+				return
+			}
+			seen[key] = struct{}{}
+			// The merged segment becomes the oldest one, so there is nothing
+			// left for a tombstone to hide and the key can be dropped.
+			if !deleted {
+				positions[key] = KeyPosition{segment: s, position: position}
+			}
+		})
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	keys := make([]string, 0, len(positions))
+	for key := range positions {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	w, err := newTableWriter(tmpPath, db.fileMode)
+	if err != nil {
+		return 0, err
+	}
+	filter := newBloomFilter(len(keys))
+	for i, key := range keys {
+		if err := ctx.Err(); err != nil {
+			w.abort()
+			return 0, err
+		}
+		pos := positions[key]
+		e, err := pos.segment.getFromSegment(pos.position)
+		if errors.Is(err, ErrNotFound) {
+			// The record expired since the scan, so it is dropped here.
+			continue
+		}
+		if err != nil {
+			// The merged segments may hold the only copy of the key, so they
+			// are kept as they are.
+			w.abort()
+			return 0, fmt.Errorf("cannot read %s from %s: %w", key, pos.segment.filePath, err)
+		}
+		if err := w.add(e); err != nil {
+			w.abort()
+			return 0, err
+		}
+		filter.add(key)
+
+		db.mu.Lock()
+		db.compaction.Progress = float64(i+1) / float64(len(keys))
+		db.mu.Unlock()
+	}
+	table, err := w.finish()
+	if err != nil {
+		os.Remove(tmpPath)
+		return 0, err
+	}
+
+	if err := os.Rename(tmpPath, filePath); err != nil {
+		os.Remove(tmpPath)
+		return 0, err
+	}
+
+	newSegment := newSegment(filePath)
+	newSegment.table = table
+	for _, s := range merged {
+		if s.version > newSegment.version {
+			newSegment.version = s.version
+		}
+	}
+	// The filter is only an optimization: without it the segment is
+	// searched for every key.
+	if err := writeBloomFilter(filePath+bloomSuffix, filter, table.end, db.fileMode); err == nil {
+		newSegment.filter = filter
+	}
+	if err := syncDir(db.dir); err != nil {
+		newSegment.removeFiles()
+		return 0, err
+	}
+	stat, err := os.Stat(filePath)
+	if err != nil {
+		newSegment.removeFiles()
+		return 0, err
+	}
+
+	db.mu.Lock()
+	if !hasPrefix(db.segments, merged) {
+		db.mu.Unlock()
+		newSegment.removeFiles()
+		return 0, fmt.Errorf("merged segments were replaced during compaction")
+	}
+	segments := append([]*Segment{newSegment}, db.segments[len(merged):]...)
+	err = db.writeManifest(segments)
+	if err == nil {
+		db.segments = segments
+	}
+	db.mu.Unlock()
+	if err != nil {
+		newSegment.removeFiles()
+		return 0, err
+	}
+
+	for _, s := range merged {
+		s.retire()
+	}
+	return mergedSize - stat.Size(), nil
+}
+
+func hasPrefix(segments, prefix []*Segment) bool {
+	if len(segments) < len(prefix) {
+		return false
+	}
+	for i, s := range prefix {
+		if segments[i] != s {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,219 @@
+package datastore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestDb_CompactionStress(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDb(dir, 500)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const (
+		writers = 8
+		rounds  = 200
+		keys    = 20
+	)
+	var wg sync.WaitGroup
+	for w := 0; w < writers; w++ {
+		w := w
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < rounds; i++ {
+				key := fmt.Sprintf("writer%d-key%d", w, i%keys)
+				if err := db.Put(key, fmt.Sprintf("value%d", i)); err != nil {
+					t.Errorf("Cannot put %s: %s", key, err)
+					return
+				}
+				if i%keys == 0 {
+					if _, err := db.Get(key); err != nil {
+						t.Errorf("Cannot get %s: %s", key, err)
+						return
+					}
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	check := func(t *testing.T, db *Db) {
+		t.Helper()
+		for w := 0; w < writers; w++ {
+			for k := 0; k < keys; k++ {
+				key := fmt.Sprintf("writer%d-key%d", w, k)
+				value, err := db.Get(key)
+				if err != nil {
+					t.Fatalf("Lost %s: %s", key, err)
+				}
+				assertEqual(t, value, fmt.Sprintf("value%d", rounds-keys+k))
+			}
+		}
+		assertEqual(t, db.Stats().Keys, writers*keys)
+	}
+
+	t.Run("keeps concurrent writes", func(t *testing.T) {
+		check(t, db)
+	})
+
+	t.Run("reopen", func(t *testing.T) {
+		if err := db.Close(); err != nil {
+			t.Fatal(err)
+		}
+		files, err := segmentFiles(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		reopened, err := NewDb(dir, 500)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer reopened.Close()
+
+		assertEqual(t, len(files), len(reopened.segmentList()))
+		check(t, reopened)
+	})
+}
+
+func TestDb_CompactionPolicy(t *testing.T) {
+	open := func(t *testing.T, policy CompactionPolicy) *Db {
+		t.Helper()
+		dir, err := ioutil.TempDir("", "test-db")
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { os.RemoveAll(dir) })
+
+		db, err := Open(dir, WithSegmentSize(150), WithCompaction(policy))
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { db.Close() })
+		return db
+	}
+	overwrite := func(t *testing.T, db *Db, times int) {
+		t.Helper()
+		for i := 0; i < times; i++ {
+			if err := db.Put("key", fmt.Sprintf("value%d", i)); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	waitSegments := func(db *Db, count int) {
+		for i := 0; i < 100 && len(db.segmentList()) != count; i++ {
+			time.Sleep(20 * time.Millisecond)
+		}
+	}
+
+	t.Run("disabled", func(t *testing.T) {
+		db := open(t, CompactionPolicy{Disabled: true})
+		overwrite(t, db, 10)
+		time.Sleep(100 * time.Millisecond)
+		assertSegmentsCount(t, db, 5)
+
+		if err := db.Compact(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		assertSegmentsCount(t, db, 2)
+		value, err := db.Get("key")
+		if err != nil {
+			t.Fatal(err)
+		}
+		assertEqual(t, value, "value9")
+
+		stats := db.CompactionStats()
+		assertEqual(t, stats.Compactions, 1)
+		assertEqual(t, stats.Running, false)
+		if stats.LastBytesReclaimed <= 0 || stats.TotalBytesReclaimed != stats.LastBytesReclaimed {
+			t.Errorf("Bad reclaimed bytes: %+v", stats)
+		}
+	})
+
+	t.Run("dead ratio", func(t *testing.T) {
+		db := open(t, CompactionPolicy{MaxSegments: -1, DeadRatio: 0.5})
+		overwrite(t, db, 3)
+		for i := 0; i < 100 && db.CompactionStats().Compactions == 0; i++ {
+			time.Sleep(20 * time.Millisecond)
+		}
+		// The sealed segment holds two versions of the key.
+		if db.CompactionStats().Compactions == 0 {
+			t.Error("Dead records did not start a compaction")
+		}
+		value, err := db.Get("key")
+		if err != nil {
+			t.Fatal(err)
+		}
+		assertEqual(t, value, "value2")
+	})
+
+	t.Run("interval", func(t *testing.T) {
+		db := open(t, CompactionPolicy{MaxSegments: -1, Interval: 10 * time.Millisecond})
+		overwrite(t, db, 6)
+		waitSegments(db, 2)
+		assertSegmentsCount(t, db, 2)
+	})
+
+	t.Run("cancelled", func(t *testing.T) {
+		db := open(t, CompactionPolicy{Disabled: true})
+		overwrite(t, db, 6)
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		if err := db.Compact(ctx); err != context.Canceled {
+			t.Errorf("Expected context.Canceled, got %v", err)
+		}
+		assertSegmentsCount(t, db, 3)
+	})
+
+	t.Run("damaged record", func(t *testing.T) {
+		db := open(t, CompactionPolicy{Disabled: true})
+		for i := 1; i <= 6; i++ {
+			if err := db.Put(fmt.Sprintf("key%d", i), fmt.Sprintf("value%d", i)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		segments := len(db.segmentList())
+		// Flip a byte of the value of key2, which is in a sealed segment.
+		s, position, err := db.getSegmentAndPosition("key2")
+		if err != nil {
+			t.Fatal(err)
+		}
+		s.release()
+		f, err := os.OpenFile(s.filePath, os.O_RDWR, 0o600)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.WriteAt([]byte{'X'}, position+headerSize+versionSize+4)
+		f.Close()
+
+		if err := db.Compact(context.Background()); err == nil {
+			t.Error("Compaction skipped a damaged record")
+		}
+		assertSegmentsCount(t, db, segments)
+		if _, err := db.Get("key2"); err == nil || errors.Is(err, ErrNotFound) {
+			t.Errorf("Expected a checksum error for key2, got %v", err)
+		}
+		value, _ := db.Get("key1")
+		assertEqual(t, value, "value1")
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		_, err := Open(t.TempDir(), WithSegmentSize(85), WithCompaction(CompactionPolicy{DeadRatio: 1.5}))
+		if err == nil {
+			t.Error("Expected an error for a bad dead bytes ratio")
+		}
+	})
+}
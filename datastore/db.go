@@ -2,49 +2,107 @@ package datastore
 
 import (
 	"bufio"
-	"encoding/binary"
+	"errors"
 	"fmt"
-	"io"
+	"log"
 	"os"
 	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 const (
-	outFileName = "current-data"
-	bufSize     = 8192
+	outFileName   = "current-data"
+	compactSuffix = ".compact"
+	bufSize       = 8192
 )
 
-var ErrNotFound = fmt.Errorf("record does not exist")
+var (
+	ErrNotFound  = fmt.Errorf("record does not exist")
+	ErrWrongType = fmt.Errorf("wrong value type")
+)
 
 type hashIndex map[string]int64
 
 type Db struct {
-	out              *os.File
-	outPath          string
-	outOffset        int64
-	dir              string
-	segmentSize      int64
+	out          *os.File
+	outPath      string
+	outOffset    int64
+	dir          string
+	segmentSize  int64
+	fileMode     os.FileMode
+	syncMode     SyncMode
+	syncInterval time.Duration
+	unsynced     bool
+	repair       bool
+	readOnly     bool
+	// lock holds the lock of the directory while the store is open.
+	lock             *os.File
+	logger           *log.Logger
+	report           RecoveryReport
 	lastSegmentIndex int
-	indexOps         chan IndexOp
-	keyPositions     chan *KeyPosition
-	putOps           chan entry
-
-	index    hashIndex
-	segments []*Segment
+	// version is the highest record version assigned by the put routine.
+	version atomic.Int64
+	// outVersion is the highest record version in the active segment.
+	outVersion   int64
+	indexOps     chan IndexOp
+	keyPositions chan *KeyPosition
+	putOps       chan *writeOp
+	snapshotOps  chan chan *Snapshot
+
+	index hashIndex
+	// mu guards the segment list and the manifest that records it.
+	mu          sync.Mutex
+	segments    []*Segment
+	policy      CompactionPolicy
+	compaction  CompactionStats
+	compactOps  chan compactOp
+	sealed      chan struct{}
+	compactions sync.WaitGroup
+	closing     chan struct{}
+	closeOnce   sync.Once
+	// writer is done once the put routine has returned. The index routine
+	// is stopped after it, since the put routine updates the index.
+	writer    sync.WaitGroup
+	stopIndex chan struct{}
+
+	// watchMu guards the watchers that the put routine sends events to.
+	watchMu  sync.Mutex
+	watchers map[*watcher]struct{}
 }
 
 type Segment struct {
-	outOffset int64
-	index     hashIndex
-	filePath  string
-	mu sync.Mutex
+	outOffset  int64
+	index      hashIndex
+	tombstones map[string]struct{}
+	// table is set for sorted segments written by compaction. They keep
+	// only a sparse index in memory instead of the hash index.
+	table *sparseIndex
+	// filter tells which keys are certainly absent from a sorted segment.
+	filter   *bloomFilter
+	filePath string
+	// version is the highest record version of a sealed segment, found
+	// when it was loaded or set when it was sealed. A sorted segment keeps
+	// the highest version of the segments merged into it, so the writes up
+	// to that version may be gone from the store.
+	version int64
+	mu      sync.Mutex
+	// readers counts lookups and iterators using the segment. The files of
+	// a retired segment are removed once its last reader is done.
+	readers int
+	retired bool
+	removed bool
 }
 
 type IndexOp struct {
 	isWrite bool
 	key     string
-	index   int64
+	records []writtenRecord
+	done    chan struct{}
 }
 
 type KeyPosition struct {
@@ -52,38 +110,126 @@ type KeyPosition struct {
 	position int64
 }
 
+// NewDb opens the store in dir with the given segment size and the defaults
+// of the other options.
 func NewDb(dir string, segmentSize int64) (*Db, error) {
+	return Open(dir, WithSegmentSize(segmentSize))
+}
+
+// Open opens the store in dir. Invalid options are reported with an
+// *OptionError. The directory is locked for the store, opening it again
+// before Close fails with ErrLocked.
+func Open(dir string, opts ...Option) (*Db, error) {
+	var o Options
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return openDb(dir, o)
+}
+
+func openDb(dir string, opts Options) (*Db, error) {
+	opts, err := opts.withDefaults()
+	if err != nil {
+		return nil, err
+	}
+	lock, err := lockDir(dir, !opts.ReadOnly, opts.FileMode)
+	if err != nil {
+		return nil, err
+	}
+
 	db := &Db{
 		dir:          dir,
-		segmentSize:  segmentSize,
+		segmentSize:  opts.SegmentSize,
+		fileMode:     opts.FileMode,
+		syncMode:     opts.Sync,
+		syncInterval: opts.SyncInterval,
+		repair:       opts.Repair,
+		readOnly:     opts.ReadOnly,
+		logger:       opts.Logger,
 		segments:     make([]*Segment, 0),
 		indexOps:     make(chan IndexOp),
 		keyPositions: make(chan *KeyPosition),
-		putOps:       make(chan entry),
+		putOps:       make(chan *writeOp),
+		snapshotOps:  make(chan chan *Snapshot),
+		policy:       opts.Compaction,
+		compactOps:   make(chan compactOp),
+		sealed:       make(chan struct{}, 1),
+		closing:      make(chan struct{}),
+		stopIndex:    make(chan struct{}),
+		lock:         lock,
+		watchers:     make(map[*watcher]struct{}),
 	}
 
-	err := db.createSegment()
-	if err != nil {
+	if err := db.open(); err != nil {
+		if db.out != nil {
+			db.out.Close()
+		}
+		lock.Close()
 		return nil, err
 	}
-
-	err = db.recover()
-	if err != nil && err != io.EOF {
-		return nil, err
+	if db.readOnly {
+		// Lookups go through the index routine, nothing else runs.
+		db.startIndexRoutine()
+		return db, nil
 	}
 
 	db.startIndexRoutine()
 	db.startPutRoutine()
+	db.startCompactionRoutine()
 
 	return db, nil
 }
 
+// open loads the segments and, unless the store is read-only, opens the
+// active segment.
+func (db *Db) open() error {
+	if err := db.recover(); err != nil {
+		return err
+	}
+	if db.readOnly {
+		return nil
+	}
+	if len(db.segments) == 0 || db.getLastSegment().table != nil {
+		return db.createSegment()
+	}
+	if err := db.openSegment(db.getLastSegment()); err != nil {
+		return err
+	}
+	db.outVersion = db.getLastSegment().version
+	return db.writeManifest(db.segments)
+}
+
+// writeManifest records the segments and the current version in the
+// manifest. Once the store is open, the caller holds db.mu.
+func (db *Db) writeManifest(segments []*Segment) error {
+	return writeManifest(db.dir, segments, db.version.Load(), db.fileMode)
+}
+
+// OpenReadOnly opens the store in dir for lookups and scans of its current
+// files. It shares the directory with other read-only users but not with a
+// writer, so it is meant for inspecting a store while its server is down.
+func OpenReadOnly(dir string) (*Db, error) {
+	return Open(dir, WithReadOnly())
+}
+
 func (db *Db) startIndexRoutine() {
 	go func() {
 		for {
-			op := <-db.indexOps
+			var op IndexOp
+			select {
+			case op = <-db.indexOps:
+			case <-db.stopIndex:
+				return
+			}
 			if op.isWrite {
-				db.setKey(op.key, op.index)
+				for _, r := range op.records {
+					if r.marker {
+						db.outOffset += r.size
+					} else {
+						db.setKey(r.key, r.size, r.deleted)
+					}
+				}
+				close(op.done)
 			} else {
 				segment, position, err := db.getSegmentAndPosition(op.key)
 				if err != nil {
@@ -99,249 +245,567 @@ func (db *Db) startIndexRoutine() {
 	}()
 }
 
+// createSegment starts a new active segment. It is recorded in the manifest
+// before any record is written to it.
 func (db *Db) createSegment() error {
-	filePath := db.getNewFileName()
-	f, err := os.OpenFile(filePath, os.O_APPEND|os.O_RDWR|os.O_CREATE, 0777)
+	newSegment := newSegment(db.getNewFileName())
+	f, size, err := openSegmentFile(newSegment.filePath, db.fileMode)
 	if err != nil {
 		return err
 	}
 
-	newSegment := &Segment{
-		filePath: filePath,
-		index:    make(hashIndex),
+	db.mu.Lock()
+	segments := append(db.segments[:len(db.segments):len(db.segments)], newSegment)
+	err = db.writeManifest(segments)
+	if err == nil {
+		db.segments = segments
+	}
+	db.mu.Unlock()
+	if err != nil {
+		f.Close()
+		os.Remove(newSegment.filePath)
+		return err
 	}
+	db.setOutput(f, size, newSegment.filePath)
+	db.notifySealed()
 
-	db.out = f
-	db.outOffset = 0
-	db.segments = append(db.segments, newSegment)
-	db.outPath = filePath
+	return nil
+}
 
-	if len(db.segments) >= 3 {
-		go db.compactOldSegments()
+// openSegment makes s the active segment that new records are appended to.
+func (db *Db) openSegment(s *Segment) error {
+	f, size, err := openSegmentFile(s.filePath, db.fileMode)
+	if err != nil {
+		return err
 	}
-
+	db.setOutput(f, size, s.filePath)
 	return nil
 }
 
-func (db *Db) getPos(key string) *KeyPosition {
+func openSegmentFile(path string, perm os.FileMode) (*os.File, int64, error) {
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_RDWR|os.O_CREATE, perm)
+	if err != nil {
+		return nil, 0, err
+	}
+	stat, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, 0, err
+	}
+	return f, stat.Size(), nil
+}
+
+func (db *Db) setOutput(f *os.File, size int64, path string) {
+	if db.out != nil {
+		db.out.Close()
+	}
+	db.out = f
+	db.outOffset = size
+	db.outPath = path
+}
+
+func newSegment(filePath string) *Segment {
+	return &Segment{
+		filePath:   filePath,
+		index:      make(hashIndex),
+		tombstones: make(map[string]struct{}),
+	}
+}
+
+func (db *Db) getPos(key string) (*KeyPosition, error) {
 	readOp := IndexOp{
 		isWrite: false,
 		key:     key,
 	}
-	db.indexOps <- readOp
-	return <-db.keyPositions
+	select {
+	case db.indexOps <- readOp:
+		return <-db.keyPositions, nil
+	case <-db.stopIndex:
+		return nil, ErrClosed
+	}
 }
 
 func (db *Db) getNewFileName() string {
+	db.mu.Lock()
+	defer db.mu.Unlock()
 	result := filepath.Join(db.dir, fmt.Sprintf("%s%d", outFileName, db.lastSegmentIndex))
 	db.lastSegmentIndex++
 	return result
 }
 
-func (db *Db) compactOldSegments() {
-	filePath := db.getNewFileName()
-	newSegment := &Segment{
-		filePath: filePath,
-		index:    make(hashIndex),
+// acquire registers a reader of the segment. It fails if the segment has
+// been retired and its files are already removed.
+func (s *Segment) acquire() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.removed {
+		return false
 	}
-	var offset int64
+	s.readers++
+	return true
+}
 
-	f, err := os.OpenFile(filePath, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0o600)
-	if err != nil {
-		return
+func (s *Segment) release() {
+	s.mu.Lock()
+	s.readers--
+	remove := s.retired && s.readers == 0 && !s.removed
+	if remove {
+		s.removed = true
 	}
-	defer f.Close()
+	s.mu.Unlock()
 
-	lastSegmentIndex := len(db.segments) - 2
-	for i := 0; i <= lastSegmentIndex; i++ {
-		s := db.segments[i]
-		s.mu.Lock()
-		for key, index := range s.index {
-			if i < lastSegmentIndex && checkKeyInSegments(db.segments[i+1:lastSegmentIndex+1], key) {
-				continue
-			}
+	if remove {
+		s.removeFiles()
+	}
+}
 
-			value, _ := s.getFromSegment(index)
-			e := entry{
-				key:   key,
-				value: value,
-			}
+// retire marks a segment that is no longer listed in the manifest.
+func (s *Segment) retire() {
+	s.mu.Lock()
+	s.retired = true
+	remove := s.readers == 0 && !s.removed
+	if remove {
+		s.removed = true
+	}
+	s.mu.Unlock()
+
+	if remove {
+		s.removeFiles()
+	}
+}
+
+func (s *Segment) removeFiles() {
+	os.Remove(s.filePath)
+	os.Remove(s.filePath + bloomSuffix)
+	os.Remove(s.filePath + hintSuffix)
+}
 
-			n, err := f.Write(e.Encode())
-			if err == nil {
-				newSegment.index[key] = offset
-				offset += int64(n)
+// acquireSegments returns the current segments, oldest first, registered as
+// used by the caller. They must be passed to releaseSegments afterwards.
+func (db *Db) acquireSegments() []*Segment {
+	for {
+		segments := db.segmentList()
+		acquired := 0
+		for _, s := range segments {
+			if !s.acquire() {
+				break
 			}
+			acquired++
 		}
-		s.mu.Unlock()
+		if acquired == len(segments) {
+			return segments
+		}
+		// A compaction has replaced the segments in the meantime.
+		releaseSegments(segments[:acquired])
 	}
-
-	db.segments = []*Segment{newSegment, db.getLastSegment()}
 }
 
-func checkKeyInSegments(segments []*Segment, key string) bool {
+func releaseSegments(segments []*Segment) {
 	for _, s := range segments {
-		s.mu.Lock()
-		if _, ok := s.index[key]; ok {
-			s.mu.Unlock()
-			return true
-		}
-		s.mu.Unlock()
+		s.release()
 	}
-	return false
 }
 
-func (db *Db) recover() error {
-	for _, segment := range db.segments {
-		file, err := os.Open(segment.filePath)
-		if err != nil {
-			return err
-		}
-		defer file.Close()
+type segmentFile struct {
+	name  string
+	index int
+}
 
-		var buf [bufSize]byte
-		in := bufio.NewReaderSize(file, bufSize)
+// segmentFiles lists the segment files in dir sorted by their sequence number.
+func segmentFiles(dir string) ([]segmentFile, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
 
-		for err == nil {
-			header, err := in.Peek(bufSize)
-			if err == io.EOF {
-				if len(header) == 0 {
-					return err
-				}
-			} else if err != nil {
-				return err
-			}
+	var files []segmentFile
+	for _, e := range entries {
+		name := e.Name()
+		if e.IsDir() || !strings.HasPrefix(name, outFileName) {
+			continue
+		}
+		index, err := strconv.Atoi(strings.TrimPrefix(name, outFileName))
+		if err != nil || index < 0 {
+			continue
+		}
+		files = append(files, segmentFile{name: name, index: index})
+	}
 
-			size := binary.LittleEndian.Uint32(header)
-			var data []byte
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].index < files[j].index
+	})
+	return files, nil
+}
 
-			if size < bufSize {
-				data = buf[:size]
-			} else {
-				data = make([]byte, size)
-			}
+// SegmentFiles returns the paths of the live segment files in dir, oldest
+// first. Stores without a manifest are ordered by segment numbers.
+func SegmentFiles(dir string) ([]string, error) {
+	names, _, _, err := readManifest(dir)
+	if os.IsNotExist(err) {
+		var files []segmentFile
+		files, err = segmentFiles(dir)
+		for _, file := range files {
+			names = append(names, file.name)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
 
-			n, err := in.Read(data)
+	paths := make([]string, len(names))
+	for i, name := range names {
+		paths[i] = filepath.Join(dir, name)
+	}
+	return paths, nil
+}
 
-			if err != nil {
-				return err
-			}
+// Close stops the routines of the store, waiting for a running compaction
+// and a write in progress, and closes the active segment. A read-only store
+// has no active segment. The lock of the directory is released last.
+func (db *Db) Close() error {
+	db.closeOnce.Do(func() {
+		close(db.closing)
+		db.compactions.Wait()
+		db.writer.Wait()
+		close(db.stopIndex)
+	})
+	var err error
+	if db.out != nil {
+		err = db.out.Close()
+	}
+	if lockErr := db.lock.Close(); err == nil {
+		err = lockErr
+	}
+	return err
+}
 
-			if n != int(size) {
-				return fmt.Errorf("corrupted file")
-			}
+func (db *Db) setKey(key string, n int64, deleted bool) {
+	db.getLastSegment().setKey(key, db.outOffset, deleted)
+	db.outOffset += n
+}
 
-			var e entry
-			e.Decode(data)
-			db.setKey(e.key, int64(n))
-		}
+func (s *Segment) setKey(key string, position int64, deleted bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.index[key] = position
+	if deleted {
+		s.tombstones[key] = struct{}{}
+	} else {
+		delete(s.tombstones, key)
 	}
-	return nil
 }
 
-func (db *Db) Close() error {
-	return db.out.Close()
+// Stats describes the current state of the store.
+type Stats struct {
+	Segments int
+	Keys     int
 }
 
-func (db *Db) setKey(key string, n int64) {
-	db.getLastSegment().mu.Lock()
-	defer db.getLastSegment().mu.Unlock()
+func (db *Db) Stats() Stats {
+	segments := db.acquireSegments()
+	defer releaseSegments(segments)
+	return Stats{
+		Segments: len(segments),
+		Keys:     len(livePositions(segments, "")),
+	}
+}
 
-	db.getLastSegment().index[key] = db.outOffset
-	db.outOffset += n
+// Size returns the number of bytes taken by the segment files, including
+// records that wait for compaction.
+func (db *Db) Size() (int64, error) {
+	segments := db.acquireSegments()
+	defer releaseSegments(segments)
+	var size int64
+	for _, s := range segments {
+		stat, err := os.Stat(s.filePath)
+		if err != nil {
+			return 0, err
+		}
+		size += stat.Size()
+	}
+	return size, nil
 }
 
+// getSegmentAndPosition finds the newest record of the key. The returned
+// segment is acquired for the caller.
 func (db *Db) getSegmentAndPosition(key string) (*Segment, int64, error) {
-	for i := range db.segments {
-		s := db.segments[len(db.segments)-i-1]
-		s.mu.Lock()
-		pos, ok := s.index[key]
+	segments := db.acquireSegments()
+	defer releaseSegments(segments)
+
+	s, position, err := findKey(segments, key)
+	if err != nil {
+		return nil, 0, err
+	}
+	s.acquire()
+	return s, position, nil
+}
+
+// findKey finds the newest record of the key in segments.
+func findKey(segments []*Segment, key string) (*Segment, int64, error) {
+	for i := range segments {
+		s := segments[len(segments)-i-1]
+		pos, deleted, ok, err := s.lookup(key)
+		if err != nil {
+			return nil, 0, err
+		}
 		if ok {
-			s.mu.Unlock()
+			if deleted {
+				return nil, 0, ErrNotFound
+			}
 			return s, pos, nil
 		}
-		s.mu.Unlock()
 	}
 
 	return nil, 0, ErrNotFound
 }
 
-func (db *Db) Get(key string) (string, error) {
-	keyPos := db.getPos(key)
-	if keyPos == nil {
-		return "", ErrNotFound
+// lookup finds the position of the newest record of the key in the segment.
+func (s *Segment) lookup(key string) (position int64, deleted, ok bool, err error) {
+	if s.table != nil {
+		if s.filter != nil && !s.filter.mayContain(key) {
+			return 0, false, false, nil
+		}
+		return s.table.find(s.filePath, key)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	position, ok = s.index[key]
+	_, deleted = s.tombstones[key]
+	return position, deleted, ok, nil
+}
+
+// each calls fn for every key of the segment with the position of its
+// newest record.
+func (s *Segment) each(fn func(key string, position int64, deleted bool)) error {
+	if s.table != nil {
+		return s.table.each(s.filePath, fn)
 	}
-	value, err := keyPos.segment.getFromSegment(keyPos.position)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for key, position := range s.index {
+		_, deleted := s.tombstones[key]
+		fn(key, position, deleted)
+	}
+	return nil
+}
+
+func (db *Db) Get(key string) (string, error) {
+	e, err := db.getEntry(key, TypeString)
 	if err != nil {
 		return "", err
 	}
-	return value, nil
+	return e.value, nil
 }
 
-func (db *Db) getLastSegment() *Segment {
-	return db.segments[len(db.segments)-1]
+// GetWithExpiry returns a string value together with its expiry time, which
+// is zero for values stored without a TTL.
+func (db *Db) GetWithExpiry(key string) (string, time.Time, error) {
+	item, err := db.GetItem(key)
+	return item.Value, item.ExpiresAt, err
 }
 
-func (db *Db) startPutRoutine() {
-	go func() {
-		for {
-			entry := <-db.putOps
-			length := entry.getLength()
+// Item is a string value together with the metadata of its record.
+type Item struct {
+	Value   string
+	Version int64
+	// ExpiresAt is zero for values stored without a TTL.
+	ExpiresAt time.Time
+}
 
-			stat, err := db.out.Stat()
-			if err != nil {
-				entry.done <- err
-				continue
-			}
+// GetItem reads a string value and its metadata from a single record.
+func (db *Db) GetItem(key string) (Item, error) {
+	e, err := db.getEntry(key, TypeString)
+	if err != nil {
+		return Item{}, err
+	}
+	item := Item{Value: e.value, Version: e.version}
+	if e.expires != 0 {
+		item.ExpiresAt = time.Unix(0, e.expires)
+	}
+	return item, nil
+}
 
-			if stat.Size()+length > db.segmentSize {
-				if err := db.createSegment(); err != nil {
-					entry.done <- err
-					continue
-				}
-			}
+func (db *Db) GetInt64(key string) (int64, error) {
+	e, err := db.getEntry(key, TypeInt64)
+	if err != nil {
+		return 0, err
+	}
+	return decodeInt64(e.value)
+}
 
-			n, err := db.out.Write(entry.Encode())
-			if err == nil {
-				db.indexOps <- IndexOp{
-					isWrite: true,
-					key:     entry.key,
-					index:   int64(n),
-				}
-			}
-			entry.done <- nil
-		}
-	}()
+func (db *Db) GetBytes(key string) ([]byte, error) {
+	e, err := db.getEntry(key, TypeBytes)
+	if err != nil {
+		return nil, err
+	}
+	return []byte(e.value), nil
+}
+
+func (db *Db) getEntry(key string, vtype ValueType) (*entry, error) {
+	e, err := db.getAnyEntry(key)
+	if err != nil {
+		return nil, err
+	}
+	return checkType(e, vtype)
+}
+
+// getAnyEntry reads the newest record of the key whatever its type.
+func (db *Db) getAnyEntry(key string) (*entry, error) {
+	keyPos, err := db.getPos(key)
+	if err != nil {
+		return nil, err
+	}
+	if keyPos == nil {
+		return nil, ErrNotFound
+	}
+	e, err := keyPos.segment.getFromSegment(keyPos.position)
+	keyPos.segment.release()
+	return e, err
+}
+
+func checkType(e *entry, vtype ValueType) (*entry, error) {
+	if e.vtype != vtype {
+		return nil, fmt.Errorf("%w: %s is stored as %s", ErrWrongType, e.key, e.vtype)
+	}
+	return e, nil
+}
+
+func (db *Db) getLastSegment() *Segment {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	return db.segments[len(db.segments)-1]
+}
+
+// segmentList returns a copy of the current segment list.
+func (db *Db) segmentList() []*Segment {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	return append([]*Segment(nil), db.segments...)
 }
 
 func (db *Db) Put(key, value string) error {
-	done := make(chan error)
-	entry := entry{
+	return db.put(entry{
 		key:   key,
 		value: value,
-		done: done,
+		vtype: TypeString,
+	})
+}
+
+// PutWithTTL stores a string value that reads as missing once ttl has
+// passed. Expired records are dropped by compaction.
+func (db *Db) PutWithTTL(key, value string, ttl time.Duration) error {
+	if ttl <= 0 {
+		return fmt.Errorf("ttl must be positive, got %s", ttl)
 	}
-	db.putOps <- entry
-	return <-done
+	return db.put(entry{
+		key:     key,
+		value:   value,
+		vtype:   TypeString,
+		expires: time.Now().Add(ttl).UnixNano(),
+	})
+}
+
+func (db *Db) PutInt64(key string, value int64) error {
+	return db.put(entry{
+		key:   key,
+		value: encodeInt64(value),
+		vtype: TypeInt64,
+	})
+}
+
+func (db *Db) PutBytes(key string, value []byte) error {
+	return db.put(entry{
+		key:   key,
+		value: string(value),
+		vtype: TypeBytes,
+	})
+}
+
+func (db *Db) put(e entry) error {
+	_, err := db.putVersioned(e)
+	return err
 }
 
-func (s *Segment) getFromSegment(position int64) (string, error) {
+// putVersioned writes the entry and returns the version it was given.
+func (db *Db) putVersioned(e entry) (int64, error) {
+	op := &writeOp{
+		entries: []entry{e},
+		done:    make(chan error),
+	}
+	if err := db.submit(op); err != nil {
+		return 0, err
+	}
+	return op.entries[0].version, nil
+}
+
+// submit hands the operation to the put routine and waits for the result.
+func (db *Db) submit(op *writeOp) error {
+	if db.readOnly {
+		return ErrReadOnly
+	}
+	select {
+	case db.putOps <- op:
+		return <-op.done
+	case <-db.closing:
+		return ErrClosed
+	}
+}
+
+// Increment atomically adds delta to the int64 value stored under the key and
+// returns the result. A missing key is treated as zero.
+func (db *Db) Increment(key string, delta int64) (int64, error) {
+	var result int64
+	err := db.put(entry{
+		key:   key,
+		vtype: TypeInt64,
+		update: func(e *entry) error {
+			current, err := db.GetInt64(key)
+			if err != nil && !errors.Is(err, ErrNotFound) {
+				return err
+			}
+			result = current + delta
+			e.value = encodeInt64(result)
+			return nil
+		},
+	})
+	if err != nil {
+		return 0, err
+	}
+	return result, nil
+}
+
+// Delete removes the key by appending a tombstone record to the active
+// segment. Deleting a missing key is not an error.
+func (db *Db) Delete(key string) error {
+	return db.put(entry{
+		key:     key,
+		deleted: true,
+	})
+}
+
+func (s *Segment) getFromSegment(position int64) (*entry, error) {
 	file, err := os.Open(s.filePath)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 	defer file.Close()
 
 	_, err = file.Seek(position, 0)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
 	reader := bufio.NewReader(file)
-	value, err := readValue(reader)
+	e, err := readRecord(reader)
 	if err != nil {
-		return "", err
+		return nil, err
+	}
+	if e.deleted || e.expired(time.Now()) {
+		return nil, ErrNotFound
 	}
 
-	return value, nil
-}
\ No newline at end of file
+	return e, nil
+}
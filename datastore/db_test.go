@@ -1,10 +1,15 @@
 package datastore
 
 import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
 	"io/ioutil"
 	"os"
 	"path/filepath"
 	"regexp"
+	"sync"
 	"testing"
 	"time"
 )
@@ -106,7 +111,7 @@ func TestDb_Segmentation(t *testing.T) {
 	}
 	defer os.RemoveAll(dir)
 
-	db, err := NewDb(dir, 85)
+	db, err := Open(dir, WithSegmentSize(150), WithCompaction(CompactionPolicy{Disabled: true}))
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -123,23 +128,20 @@ func TestDb_Segmentation(t *testing.T) {
 
 	t.Run("should start segmentation", func(t *testing.T) {
 		db.Put("key4", "value4")
-
 		assertSegmentsCount(t, db, 3)
 
-		time.Sleep(2 * time.Second)
-
+		if err := db.Compact(context.Background()); err != nil {
+			t.Fatal(err)
+		}
 		assertSegmentsCount(t, db, 2)
 	})
 
 	t.Run("shouldn't store duplicates", func(t *testing.T) {
-		file, err := os.Open(db.segments[0].filePath)
-		defer file.Close()
-
-		if err != nil {
-			t.Error(err)
+		table := db.segmentList()[0].table
+		if table == nil {
+			t.Fatal("Compacted segment is not sorted")
 		}
-		inf, _ := file.Stat()
-		assertFileSize(t, inf, 126)
+		assertEqual(t, table.end, int64(162))
 	})
 
 	t.Run("shouldn't store new values of duplicate keys", func(t *testing.T) {
@@ -148,10 +150,39 @@ func TestDb_Segmentation(t *testing.T) {
 	})
 }
 
+func TestDb_OversizedRecords(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := Open(dir, WithSegmentSize(50), WithCompaction(CompactionPolicy{Disabled: true}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	// Every record is bigger than a segment, so each one gets its own.
+	for i := 1; i <= 3; i++ {
+		if err := db.Put(fmt.Sprintf("key%d", i), fmt.Sprintf("value%d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	assertSegmentsCount(t, db, 3)
+	for _, s := range db.segmentList() {
+		stat, err := os.Stat(s.filePath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assertFileSize(t, stat, 54)
+	}
+}
+
 func assertSegmentsCount(t *testing.T, db *Db, expectedCount int) {
 	t.Helper()
-	if len(db.segments) != expectedCount {
-		t.Errorf("Something went wrong with segmentation. Expected %d files, got %d", expectedCount, len(db.segments))
+	if count := len(db.segmentList()); count != expectedCount {
+		t.Errorf("Something went wrong with segmentation. Expected %d files, got %d", expectedCount, count)
 	}
 }
 
@@ -210,4 +241,475 @@ func TestDb_Checksum(t *testing.T) {
 			t.Errorf("Expected error containing 'SHA1', but got: %v", err)
 		}
 	})
-}
\ No newline at end of file
+}
+
+func TestDb_Delete(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := Open(dir, WithSegmentSize(85), WithCompaction(CompactionPolicy{Disabled: true}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	t.Run("get after delete", func(t *testing.T) {
+		db.Put("key1", "value1")
+		db.Put("key2", "value2")
+		if err := db.Delete("key1"); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := db.Get("key1"); err != ErrNotFound {
+			t.Errorf("Expected ErrNotFound, got %v", err)
+		}
+		value, _ := db.Get("key2")
+		assertEqual(t, value, "value2")
+	})
+
+	t.Run("put after delete", func(t *testing.T) {
+		db.Put("key3", "value3")
+		db.Delete("key3")
+		db.Put("key3", "value4")
+
+		value, _ := db.Get("key3")
+		assertEqual(t, value, "value4")
+	})
+
+	t.Run("compaction drops deleted keys", func(t *testing.T) {
+		db.Put("key4", "value4")
+		if err := db.Compact(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+
+		assertSegmentsCount(t, db, 2)
+		if _, _, ok, _ := db.segmentList()[0].lookup("key1"); ok {
+			t.Error("Deleted key was copied into the compacted segment")
+		}
+		if _, err := db.Get("key1"); err != ErrNotFound {
+			t.Errorf("Expected ErrNotFound, got %v", err)
+		}
+	})
+
+	t.Run("new db process", func(t *testing.T) {
+		db.Delete("key4")
+		if err := db.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		db, err = NewDb(dir, 85)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := db.Get("key4"); err != ErrNotFound {
+			t.Errorf("Expected ErrNotFound, got %v", err)
+		}
+	})
+}
+
+func TestDb_Reopen(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := Open(dir, WithSegmentSize(100), WithCompaction(CompactionPolicy{Disabled: true}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db.Put("key1", "value1")
+	db.Put("key2", "value2")
+	db.Put("key3", "value3")
+	db.Put("key1", "value4")
+	db.Put("key5", "value5")
+	if err := db.Compact(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	db.Put("key2", "value6")
+
+	expected := map[string]string{
+		"key1": "value4",
+		"key2": "value6",
+		"key3": "value3",
+		"key5": "value5",
+	}
+	segmentsCount := len(db.segmentList())
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = Open(dir, WithSegmentSize(100), WithCompaction(CompactionPolicy{Disabled: true}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	t.Run("restores all segments", func(t *testing.T) {
+		assertSegmentsCount(t, db, segmentsCount)
+		for key, value := range expected {
+			got, err := db.Get(key)
+			if err != nil {
+				t.Errorf("Cannot get %s: %s", key, err)
+			}
+			assertEqual(t, got, value)
+		}
+	})
+
+	t.Run("appends to the newest segment", func(t *testing.T) {
+		lastPath := db.getLastSegment().filePath
+		assertEqual(t, db.outPath, lastPath)
+
+		stat, err := os.Stat(lastPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assertEqual(t, db.outOffset, stat.Size())
+	})
+
+	t.Run("continues segment numbering", func(t *testing.T) {
+		files, err := segmentFiles(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assertEqual(t, db.lastSegmentIndex, files[len(files)-1].index+1)
+	})
+}
+
+func TestDb_Close(t *testing.T) {
+	db, err := Open(t.TempDir(), WithSync(SyncInterval), WithSyncInterval(time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put("key", "value"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.Put("key", "value2"); !errors.Is(err, ErrClosed) {
+		t.Errorf("Expected ErrClosed from Put, got %v", err)
+	}
+	if _, err := db.Get("key"); !errors.Is(err, ErrClosed) {
+		t.Errorf("Expected ErrClosed from Get, got %v", err)
+	}
+	snap := db.Snapshot()
+	defer snap.Close()
+	value, err := snap.Get("key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, value, "value")
+}
+
+func TestDb_Stats(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := Open(dir, WithSegmentSize(110), WithSync(SyncAlways))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	db.Put("key1", "value1")
+	db.Put("key2", "value2")
+	db.Put("key1", "value3")
+	db.Delete("key2")
+
+	stats := db.Stats()
+	assertEqual(t, stats.Segments, 2)
+	assertEqual(t, stats.Keys, 1)
+
+	size, err := db.Size()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Three puts of 54 bytes and a delete of 48 bytes.
+	assertEqual(t, size, int64(3*54+48))
+}
+
+func TestDb_TypedValues(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDb(dir, 150)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	blob := []byte{0, 1, 2, 0xff, 0}
+
+	t.Run("put/get", func(t *testing.T) {
+		if err := db.PutInt64("counter", -7); err != nil {
+			t.Fatal(err)
+		}
+		if err := db.PutBytes("blob", blob); err != nil {
+			t.Fatal(err)
+		}
+
+		counter, err := db.GetInt64("counter")
+		if err != nil {
+			t.Fatal(err)
+		}
+		assertEqual(t, counter, int64(-7))
+
+		value, err := db.GetBytes("blob")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(value, blob) {
+			t.Errorf("Bad value returned expected %v, got %v", blob, value)
+		}
+	})
+
+	t.Run("wrong type", func(t *testing.T) {
+		if _, err := db.Get("counter"); !errors.Is(err, ErrWrongType) {
+			t.Errorf("Expected ErrWrongType, got %v", err)
+		}
+		if _, err := db.GetInt64("blob"); !errors.Is(err, ErrWrongType) {
+			t.Errorf("Expected ErrWrongType, got %v", err)
+		}
+	})
+
+	t.Run("new db process", func(t *testing.T) {
+		if err := db.Close(); err != nil {
+			t.Fatal(err)
+		}
+		db, err = NewDb(dir, 150)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		counter, err := db.GetInt64("counter")
+		if err != nil {
+			t.Fatal(err)
+		}
+		assertEqual(t, counter, int64(-7))
+	})
+}
+
+func TestDb_Increment(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDb(dir, 100000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	t.Run("missing key starts at zero", func(t *testing.T) {
+		value, err := db.Increment("counter", 5)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assertEqual(t, value, int64(5))
+
+		value, err = db.Increment("counter", -2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assertEqual(t, value, int64(3))
+	})
+
+	t.Run("concurrent increments", func(t *testing.T) {
+		var wg sync.WaitGroup
+		for i := 0; i < 20; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for j := 0; j < 10; j++ {
+					if _, err := db.Increment("parallel", 1); err != nil {
+						t.Error(err)
+					}
+				}
+			}()
+		}
+		wg.Wait()
+
+		value, err := db.GetInt64("parallel")
+		if err != nil {
+			t.Fatal(err)
+		}
+		assertEqual(t, value, int64(200))
+	})
+
+	t.Run("wrong type", func(t *testing.T) {
+		db.Put("text", "value")
+		if _, err := db.Increment("text", 1); !errors.Is(err, ErrWrongType) {
+			t.Errorf("Expected ErrWrongType, got %v", err)
+		}
+	})
+}
+
+func TestDb_SyncModes(t *testing.T) {
+	modes := map[SyncMode]Option{
+		SyncNever:    WithSync(SyncNever),
+		SyncAlways:   WithSync(SyncAlways),
+		SyncInterval: WithSyncInterval(10 * time.Millisecond),
+	}
+
+	for mode, opt := range modes {
+		opt := opt
+		t.Run(mode.String(), func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "test-db")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+
+			db, err := Open(dir, WithSegmentSize(10000), opt)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var wg sync.WaitGroup
+			for i := 0; i < 50; i++ {
+				wg.Add(1)
+				go func(i int) {
+					defer wg.Done()
+					key := fmt.Sprintf("key%d", i)
+					if err := db.Put(key, fmt.Sprintf("value%d", i)); err != nil {
+						t.Error(err)
+					}
+				}(i)
+			}
+			wg.Wait()
+			db.Close()
+
+			db, err = Open(dir, WithSegmentSize(10000), opt)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer db.Close()
+
+			for i := 0; i < 50; i++ {
+				value, err := db.Get(fmt.Sprintf("key%d", i))
+				if err != nil {
+					t.Errorf("Cannot get key%d: %s", i, err)
+				}
+				assertEqual(t, value, fmt.Sprintf("value%d", i))
+			}
+		})
+	}
+
+	t.Run("bad interval", func(t *testing.T) {
+		if _, err := Open("", WithSync(SyncInterval)); err == nil {
+			t.Error("Expected an error for zero sync interval")
+		}
+	})
+}
+
+func BenchmarkDb_Put(b *testing.B) {
+	modes := map[SyncMode]Option{
+		SyncNever:    WithSync(SyncNever),
+		SyncAlways:   WithSync(SyncAlways),
+		SyncInterval: WithSyncInterval(10 * time.Millisecond),
+	}
+
+	for mode, opt := range modes {
+		opt := opt
+		b.Run(mode.String(), func(b *testing.B) {
+			dir, err := ioutil.TempDir("", "bench-db")
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+
+			db, err := Open(dir, WithSegmentSize(10*1024*1024), opt)
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer db.Close()
+
+			b.SetParallelism(16)
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				i := 0
+				for pb.Next() {
+					if err := db.Put(fmt.Sprintf("key%d", i%1000), "value"); err != nil {
+						b.Error(err)
+					}
+					i++
+				}
+			})
+		})
+	}
+}
+
+func BenchmarkDb_GetMissing(b *testing.B) {
+	dir, err := ioutil.TempDir("", "bench-db")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Prepare sorted segments directly, compaction would merge them.
+	for i := 0; i < 50; i++ {
+		path := filepath.Join(dir, fmt.Sprintf("%s%d", outFileName, i))
+		w, err := newTableWriter(path, DefaultFileMode)
+		if err != nil {
+			b.Fatal(err)
+		}
+		filter := newBloomFilter(1000)
+		for j := 0; j < 1000; j++ {
+			e := entry{key: fmt.Sprintf("key%02d-%04d", i, j), value: "value", vtype: TypeString}
+			if err := w.add(&e); err != nil {
+				b.Fatal(err)
+			}
+			filter.add(e.key)
+		}
+		table, err := w.finish()
+		if err != nil {
+			b.Fatal(err)
+		}
+		if err := writeBloomFilter(path+bloomSuffix, filter, table.end, DefaultFileMode); err != nil {
+			b.Fatal(err)
+		}
+	}
+
+	db, err := Open(dir, WithSegmentSize(10*1024*1024), WithCompaction(CompactionPolicy{Disabled: true}))
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer db.Close()
+
+	filters := make([]*bloomFilter, len(db.segmentList()))
+	for i, s := range db.segmentList() {
+		filters[i] = s.filter
+	}
+
+	for _, useFilters := range []bool{true, false} {
+		// The filters are swapped before the reads of the run start.
+		for i, s := range db.segmentList() {
+			s.filter = nil
+			if useFilters {
+				s.filter = filters[i]
+			}
+		}
+		b.Run(fmt.Sprintf("filters=%t", useFilters), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				if _, err := db.Get(fmt.Sprintf("missing%d", i)); err != ErrNotFound {
+					b.Fatalf("Expected ErrNotFound, got %v", err)
+				}
+			}
+		})
+	}
+}
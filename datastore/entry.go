@@ -7,94 +7,411 @@ import (
 	"encoding/binary"
 	"errors"
 	"fmt"
+	"io"
+	"math"
+	"time"
 )
 
+// Record layout (all integers are little endian):
+//
+//	0   uint32 record size
+//	4   uint8  format version
+//	5   uint8  value type
+//	6   uint8  flags
+//	7   uint8  reserved
+//	8   uint32 key size
+//	12  uint32 value size
+//	16  int64 expiry time in Unix nanoseconds, only with flagExpires
+//	    int64 record version, only with flagVersion
+//	    key, value
+//	    20 bytes of SHA1 sum of everything above
+//
+// Stores written before the format version existed hold string records with
+// a shorter header, which are still read:
+//
+//	0   uint32 record size
+//	4   uint32 key size
+//	8   uint32 value size, legacyTombstone for a deleted key
+//	12  key, value
+//	    20 bytes of SHA1 sum of everything above
+const (
+	formatVersion = 1
+	headerSize    = 16
+	expirySize    = 8
+	versionSize   = 8
+	sumSize       = sha1.Size
+
+	legacyHeaderSize = 12
+	legacyTombstone  = math.MaxUint32
+)
+
+const (
+	flagDeleted = 1 << iota
+	// flagBatch marks records written by Db.Write. They only take effect
+	// once the commit record of their batch is found.
+	flagBatch
+	flagCommit
+	// flagIndex and flagFooter mark the sparse index and the footer that
+	// close a sorted segment written by compaction.
+	flagIndex
+	flagFooter
+	// flagExpires extends the header with the time the record expires at.
+	flagExpires
+	// flagVersion extends the header with the version of the record.
+	flagVersion
+)
+
+var errChecksum = errors.New("SHA1 Sum is incorrect")
+
+// ValueType tells how the bytes of a stored value should be interpreted.
+type ValueType byte
+
+const (
+	TypeString ValueType = iota + 1
+	TypeInt64
+	TypeBytes
+)
+
+func (t ValueType) String() string {
+	switch t {
+	case TypeString:
+		return "string"
+	case TypeInt64:
+		return "int64"
+	case TypeBytes:
+		return "bytes"
+	default:
+		return fmt.Sprintf("ValueType(%d)", byte(t))
+	}
+}
+
 type entry struct {
-	key   string
-	value string
-	sum   []byte
-	done   chan error
+	key     string
+	value   string
+	vtype   ValueType
+	sum     []byte
+	deleted bool
+	batched bool
+	commit  bool
+	index   bool
+	footer  bool
+	// expires is the expiry time in Unix nanoseconds, zero for records that
+	// never expire.
+	expires int64
+	// version is assigned by the put routine from a counter of the store,
+	// zero for records written before versions existed.
+	version int64
+	// update, when set, is called by the put routine right before the entry
+	// is written, so it can derive the value from the current state.
+	update func(e *entry) error
 }
 
 func getLength(key, value string) int64 {
-	return int64(len(key) + len(value) + 12)
+	return int64(len(key) + len(value) + headerSize)
 }
 
 func (e *entry) Encode() []byte {
 	kl := len(e.key)
 	vl := len(e.value)
-	size := kl + vl + 32
+	if e.deleted {
+		vl = 0
+	}
+	hl := e.headerLength()
+	size := hl + kl + vl + sumSize
 	res := make([]byte, size)
 	binary.LittleEndian.PutUint32(res, uint32(size))
-	binary.LittleEndian.PutUint32(res[4:], uint32(kl))
-	binary.LittleEndian.PutUint32(res[8:], uint32(vl))
-	copy(res[12:], e.key)
-	copy(res[kl+12:], e.value)
-	data := make([]byte, size-20)
-	copy(data, res[:size-19])
-	sum := sha1.Sum(data)
-	copy(res[size-20:], sum[:])
+	res[4] = formatVersion
+	res[5] = byte(e.vtype)
+	if e.deleted {
+		res[6] |= flagDeleted
+	}
+	if e.batched {
+		res[6] |= flagBatch
+	}
+	if e.commit {
+		res[6] |= flagCommit
+	}
+	if e.index {
+		res[6] |= flagIndex
+	}
+	if e.footer {
+		res[6] |= flagFooter
+	}
+	extra := res[headerSize:hl]
+	if e.expires != 0 {
+		res[6] |= flagExpires
+		binary.LittleEndian.PutUint64(extra, uint64(e.expires))
+		extra = extra[expirySize:]
+	}
+	if e.version != 0 {
+		res[6] |= flagVersion
+		binary.LittleEndian.PutUint64(extra, uint64(e.version))
+	}
+	binary.LittleEndian.PutUint32(res[8:], uint32(kl))
+	binary.LittleEndian.PutUint32(res[12:], uint32(vl))
+	copy(res[hl:], e.key)
+	if !e.deleted {
+		copy(res[hl+kl:], e.value)
+	}
+	sum := sha1.Sum(res[:size-sumSize])
+	copy(res[size-sumSize:], sum[:])
 
 	return res
 }
 
+// headerLength returns the size of the record header, including the expiry
+// time and the version if the record has them.
+func (e *entry) headerLength() int {
+	return headerSize + extraHeaderSize(e.expires != 0, e.version != 0)
+}
+
+func extraHeaderSize(expires, version bool) int {
+	size := 0
+	if expires {
+		size += expirySize
+	}
+	if version {
+		size += versionSize
+	}
+	return size
+}
+
 func (e *entry) getLength() int64 {
-	return getLength(e.key, e.value)
+	extra := int64(e.headerLength() - headerSize)
+	if e.deleted {
+		return getLength(e.key, "") + extra
+	}
+	return getLength(e.key, e.value) + extra
 }
 
-func (e *entry) Decode(input []byte) {
-	kl := binary.LittleEndian.Uint32(input[4:])
-	vl := binary.LittleEndian.Uint32(input[8:])
+// expired tells whether the record has expired by now.
+func (e *entry) expired(now time.Time) bool {
+	return e.expires != 0 && now.UnixNano() >= e.expires
+}
+
+// size returns the number of bytes the encoded record takes.
+func (e *entry) size() int64 {
+	return e.getLength() + sumSize
+}
+
+func (e *entry) Decode(input []byte) error {
+	if len(input) < headerSize+sumSize {
+		return fmt.Errorf("record is too short (%d bytes)", len(input))
+	}
+	if input[4] != formatVersion {
+		return fmt.Errorf("unsupported record format version %d", input[4])
+	}
+	e.vtype = ValueType(input[5])
+	e.deleted = input[6]&flagDeleted != 0
+	e.batched = input[6]&flagBatch != 0
+	e.commit = input[6]&flagCommit != 0
+	e.index = input[6]&flagIndex != 0
+	e.footer = input[6]&flagFooter != 0
+	hl := uint32(headerSize + extraHeaderSize(input[6]&flagExpires != 0, input[6]&flagVersion != 0))
+	if len(input) < int(hl)+sumSize {
+		return fmt.Errorf("record is too short for its header (%d bytes)", len(input))
+	}
+	extra := input[headerSize:hl]
+	if input[6]&flagExpires != 0 {
+		e.expires = int64(binary.LittleEndian.Uint64(extra))
+		extra = extra[expirySize:]
+	}
+	if input[6]&flagVersion != 0 {
+		e.version = int64(binary.LittleEndian.Uint64(extra))
+	}
+
+	kl := binary.LittleEndian.Uint32(input[8:])
+	vl := binary.LittleEndian.Uint32(input[12:])
+	if uint64(hl)+uint64(kl)+uint64(vl)+sumSize != uint64(len(input)) {
+		return fmt.Errorf("record size mismatch (key %d, value %d, total %d)", kl, vl, len(input))
+	}
 	keyBuf := make([]byte, kl)
-	copy(keyBuf, input[12:kl+12])
+	copy(keyBuf, input[hl:hl+kl])
 	e.key = string(keyBuf)
 
 	valBuf := make([]byte, vl)
-	copy(valBuf, input[kl+12:kl+12+vl])
+	copy(valBuf, input[hl+kl:hl+kl+vl])
 	e.value = string(valBuf)
-	e.sum = make([]byte, 20)
-	copy(e.sum, input[kl+vl+12:])
+	e.sum = make([]byte, sumSize)
+	copy(e.sum, input[hl+kl+vl:])
+	return nil
 }
 
-func readValue(in *bufio.Reader) (string, error) {
-	header, err := in.Peek(12)
-	if err != nil {
-		return "", err
+// decodeLegacy decodes a record written before the format version existed.
+// Its size must have been checked against its header.
+func (e *entry) decodeLegacy(input []byte) {
+	kl := binary.LittleEndian.Uint32(input[4:])
+	vl := binary.LittleEndian.Uint32(input[8:])
+	e.vtype = TypeString
+	e.deleted = vl == legacyTombstone
+	if e.deleted {
+		vl = 0
 	}
-	keySize := int(binary.LittleEndian.Uint32(header[4:]))
-	valSize := int(binary.LittleEndian.Uint32(header[8:]))
+	e.key = string(input[legacyHeaderSize : legacyHeaderSize+kl])
+	e.value = string(input[legacyHeaderSize+kl : legacyHeaderSize+kl+vl])
+	e.sum = make([]byte, sumSize)
+	copy(e.sum, input[legacyHeaderSize+kl+vl:])
+}
 
-	data, err := in.Peek(12 + keySize + valSize)
-	if err != nil {
-		return "", err
+// legacyRecordSize returns the size of a record written before the format
+// version existed, as given by the key and value sizes of its header.
+func legacyRecordSize(header []byte) uint64 {
+	keySize := uint64(binary.LittleEndian.Uint32(header[4:]))
+	valSize := uint64(binary.LittleEndian.Uint32(header[8:]))
+	if valSize == legacyTombstone {
+		valSize = 0
 	}
+	return legacyHeaderSize + keySize + valSize + sumSize
+}
 
-	_, err = in.Discard(12 + keySize)
-	if err != nil {
-		return "", err
+func encodeInt64(value int64) string {
+	var buf [8]byte
+	binary.LittleEndian.PutUint64(buf[:], uint64(value))
+	return string(buf[:])
+}
+
+func decodeInt64(value string) (int64, error) {
+	if len(value) != 8 {
+		return 0, fmt.Errorf("bad int64 value size %d", len(value))
 	}
+	return int64(binary.LittleEndian.Uint64([]byte(value))), nil
+}
+
+// recordSize reads the size of the record at the position from its header.
+func recordSize(r io.ReaderAt, position int64) (int64, error) {
+	var size [4]byte
+	if _, err := r.ReadAt(size[:], position); err != nil {
+		return 0, err
+	}
+	return int64(binary.LittleEndian.Uint32(size[:])), nil
+}
+
+// Record is a segment file record as returned by RecordReader.
+type Record struct {
+	Offset  int64
+	Size    int64
+	Key     string
+	Value   []byte
+	Type    ValueType
+	Deleted bool
+	// Batch is set for records written by Db.Write and Commit for the record
+	// that completes such a batch.
+	Batch  bool
+	Commit bool
+	// Index is set for the sparse index and Footer for the footer record
+	// of a sorted segment written by compaction.
+	Index  bool
+	Footer bool
+	// ExpiresAt is the expiry time of records written with a TTL.
+	ExpiresAt time.Time
+	Version   int64
+	// Intact tells whether the record matches its checksum.
+	Intact bool
+}
 
-	valueData, err := in.Peek(valSize)
+// Int64 decodes the value of a TypeInt64 record.
+func (r *Record) Int64() (int64, error) {
+	return decodeInt64(string(r.Value))
+}
+
+// RecordReader reads the records of a segment file one after another.
+type RecordReader struct {
+	in     *bufio.Reader
+	offset int64
+}
+
+func NewRecordReader(r io.Reader) *RecordReader {
+	return &RecordReader{in: bufio.NewReaderSize(r, bufSize)}
+}
+
+// Offset returns the position of the next record.
+func (r *RecordReader) Offset() int64 {
+	return r.offset
+}
+
+// Next reads the next record and returns io.EOF at the end of the input.
+// A record that fails the checksum is still returned, with Intact unset, as
+// long as its size is known. Damage that hides where the following record
+// starts is returned as an error.
+func (r *RecordReader) Next() (*Record, error) {
+	offset := r.offset
+	e, intact, err := r.next()
 	if err != nil {
-		return "", err
+		return nil, err
+	}
+	var expiresAt time.Time
+	if e.expires != 0 {
+		expiresAt = time.Unix(0, e.expires)
 	}
-	if len(valueData) != valSize {
-		return "", fmt.Errorf("can't read value bytes (read %d, expected %d)", len(valueData), valSize)
+	return &Record{
+		Offset:    offset,
+		Size:      r.offset - offset,
+		Key:       e.key,
+		Value:     []byte(e.value),
+		Type:      e.vtype,
+		Deleted:   e.deleted,
+		Batch:     e.batched,
+		Commit:    e.commit,
+		Index:     e.index,
+		Footer:    e.footer,
+		ExpiresAt: expiresAt,
+		Version:   e.version,
+		Intact:    intact,
+	}, nil
+}
+
+func (r *RecordReader) next() (*entry, bool, error) {
+	header, err := r.in.Peek(headerSize)
+	if err == io.EOF && len(header) > 0 {
+		return nil, false, fmt.Errorf("can't read record header: %w", io.ErrUnexpectedEOF)
+	} else if err != nil {
+		return nil, false, err
+	}
+	keySize := uint64(binary.LittleEndian.Uint32(header[8:]))
+	valSize := uint64(binary.LittleEndian.Uint32(header[12:]))
+	size := uint64(headerSize+extraHeaderSize(header[6]&flagExpires != 0, header[6]&flagVersion != 0)) +
+		keySize + valSize + sumSize
+	declared := uint64(binary.LittleEndian.Uint32(header))
+	legacy := false
+	if header[4] != formatVersion || size != declared {
+		// A record of the old layout matches the sizes of its own header.
+		if legacyRecordSize(header) != declared {
+			// The size is covered by the checksum, so the record cannot be
+			// intact.
+			return nil, false, fmt.Errorf("%w: record size does not match its header", errChecksum)
+		}
+		size, legacy = declared, true
 	}
 
-	_, err = in.Discard(valSize)
+	data := make([]byte, size)
+	n, err := io.ReadFull(r.in, data)
 	if err != nil {
-		return "", err
+		return nil, false, fmt.Errorf("can't read record bytes (read %d, expected %d): %w", n, len(data), err)
 	}
+	r.offset += int64(n)
 
-	sum, err := in.Peek(20)
+	sum := data[len(data)-sumSize:]
+	realSum := sha1.Sum(data[:len(data)-sumSize])
+	intact := bytes.Equal(sum, realSum[:])
+
+	var e entry
+	if legacy {
+		e.decodeLegacy(data)
+	} else if err := e.Decode(data); err != nil && intact {
+		return nil, false, err
+	}
+	return &e, intact, nil
+}
+
+// readRecord reads a single record and verifies its checksum.
+func readRecord(in *bufio.Reader) (*entry, error) {
+	r := RecordReader{in: in}
+	e, intact, err := r.next()
 	if err != nil {
-		return "", err
+		return nil, err
 	}
-	realSum := sha1.Sum(data)
-	if !bytes.Equal(sum, realSum[:]) {
-		return "", errors.New("SHA1 Sum is incorrect")
+	if !intact {
+		return nil, errChecksum
 	}
-
-	return string(valueData), nil
-}
\ No newline at end of file
+	return e, nil
+}
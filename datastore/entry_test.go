@@ -4,11 +4,12 @@ import (
 	"bufio"
 	"bytes"
 	"crypto/sha1"
+	"io"
 	"testing"
 )
 
 func TestEntry_Encode(t *testing.T) {
-	e := entry{"key", "value", nil, make(chan error)}
+	e := entry{key: "key", value: "value", vtype: TypeString}
 	e.Decode(e.Encode())
 	if e.key != "key" {
 		t.Error("incorrect key")
@@ -16,24 +17,55 @@ func TestEntry_Encode(t *testing.T) {
 	if e.value != "value" {
 		t.Error("incorrect value")
 	}
+	if e.vtype != TypeString {
+		t.Error("incorrect value type")
+	}
+}
+
+func TestEntry_DecodeVersion(t *testing.T) {
+	e := entry{key: "key", value: "value", vtype: TypeString}
+	data := e.Encode()
+	data[4] = formatVersion + 1
+
+	if err := e.Decode(data); err == nil {
+		t.Error("Expected an error for unknown format version")
+	}
 }
 
-func TestReadValue(t *testing.T) {
-	e := entry{"key", "test-value", nil, make(chan error)}
+func TestReadRecord(t *testing.T) {
+	e := entry{key: "key", value: "test-value", vtype: TypeString}
 	data := e.Encode()
-	v, err := readValue(bufio.NewReader(bytes.NewReader(data)))
+	r, err := readRecord(bufio.NewReader(bytes.NewReader(data)))
 	if err != nil {
 		t.Fatal(err)
 	}
-	if v != "test-value" {
-		t.Errorf("Got bat value [%s]", v)
+	if r.value != "test-value" {
+		t.Errorf("Got bat value [%s]", r.value)
+	}
+}
+
+func TestReadRecord_Int64(t *testing.T) {
+	e := entry{key: "key", value: encodeInt64(-42), vtype: TypeInt64}
+	r, err := readRecord(bufio.NewReader(bytes.NewReader(e.Encode())))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.vtype != TypeInt64 {
+		t.Errorf("Got bad type %s", r.vtype)
+	}
+	v, err := decodeInt64(r.value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v != -42 {
+		t.Errorf("Got bad value %d", v)
 	}
 }
 
 func TestCheckHashSum(t *testing.T) {
-	e := entry{"key", "test-value", nil, make(chan error)}
+	e := entry{key: "key", value: "test-value", vtype: TypeString}
 
-	sumLength := len(e.key) + len(e.value) + 12
+	sumLength := len(e.key) + len(e.value) + headerSize
 	sumData := e.Encode()[:sumLength]
 	expectedSum := sha1.Sum(sumData)
 
@@ -45,3 +77,63 @@ func TestCheckHashSum(t *testing.T) {
 		t.Errorf("Check hash sum. Expected: %v, Got: %v", expectedSum, newEntry.sum)
 	}
 }
+
+func TestEntry_Tombstone(t *testing.T) {
+	e := entry{key: "key", deleted: true}
+	data := e.Encode()
+	if int64(len(data)) != e.getLength()+sumSize {
+		t.Errorf("Unexpected tombstone size %d", len(data))
+	}
+
+	var decoded entry
+	decoded.Decode(data)
+	if decoded.key != "key" || !decoded.deleted {
+		t.Errorf("Bad tombstone decoded: key [%s], deleted %t", decoded.key, decoded.deleted)
+	}
+}
+
+func TestRecordReader(t *testing.T) {
+	first := entry{key: "key1", value: "value1", vtype: TypeString}
+	second := entry{key: "key2", deleted: true}
+	data := append(first.Encode(), second.Encode()...)
+	// Damage the value of the first record.
+	data[headerSize+len(first.key)] ^= 0xff
+
+	r := NewRecordReader(bytes.NewReader(data))
+	rec, err := r.Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec.Intact || rec.Offset != 0 || rec.Size != first.size() {
+		t.Errorf("Bad first record: %+v", rec)
+	}
+
+	rec, err = r.Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !rec.Intact || !rec.Deleted || rec.Key != "key2" || rec.Offset != first.size() {
+		t.Errorf("Bad second record: %+v", rec)
+	}
+
+	if _, err := r.Next(); err != io.EOF {
+		t.Errorf("Expected io.EOF, got %v", err)
+	}
+}
+
+func TestEntry_Expiry(t *testing.T) {
+	e := entry{key: "key", value: "value", vtype: TypeString, expires: 1234567890}
+	data := e.Encode()
+	if int64(len(data)) != e.size() {
+		t.Errorf("Unexpected record size %d, expected %d", len(data), e.size())
+	}
+
+	r := NewRecordReader(bytes.NewReader(data))
+	rec, err := r.Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !rec.Intact || rec.Key != "key" || string(rec.Value) != "value" || rec.ExpiresAt.UnixNano() != 1234567890 {
+		t.Errorf("Bad record read: %+v", rec)
+	}
+}
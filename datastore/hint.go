@@ -0,0 +1,132 @@
+package datastore
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"os"
+	"sort"
+)
+
+// When a segment is sealed, its index is saved to a hint file next to it, so
+// that opening the store doesn't have to read the whole segment. Sorted
+// segments written by compaction need no hints, they carry a sparse index.
+//
+// Hint file layout (all integers are little endian):
+//
+//	0   uint64 size of the segment file the hint describes
+//	8   int64  highest record version in the segment
+//	for every key:
+//	    uint32 key size, key, uint64 record offset, uint32 record size,
+//	    uint8 flags (flagDeleted for tombstones)
+//	20 bytes of SHA1 sum of everything above
+const hintSuffix = ".hint"
+
+var errBadHint = errors.New("bad hint file")
+
+// writeHint saves the index of a sealed segment that holds no records newer
+// than version.
+func (s *Segment) writeHint(version int64, perm os.FileMode) error {
+	f, err := os.Open(s.filePath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	stat, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	keys := make([]string, 0, len(s.index))
+	for key := range s.index {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return s.index[keys[i]] < s.index[keys[j]]
+	})
+
+	data := binary.LittleEndian.AppendUint64(nil, uint64(stat.Size()))
+	data = binary.LittleEndian.AppendUint64(data, uint64(version))
+	for _, key := range keys {
+		position := s.index[key]
+		size, err := recordSize(f, position)
+		if err != nil {
+			s.mu.Unlock()
+			return err
+		}
+		var flags byte
+		if _, deleted := s.tombstones[key]; deleted {
+			flags |= flagDeleted
+		}
+		data = binary.LittleEndian.AppendUint32(data, uint32(len(key)))
+		data = append(data, key...)
+		data = binary.LittleEndian.AppendUint64(data, uint64(position))
+		data = binary.LittleEndian.AppendUint32(data, uint32(size))
+		data = append(data, flags)
+	}
+	s.mu.Unlock()
+
+	sum := sha1.Sum(data)
+	data = append(data, sum[:]...)
+	return os.WriteFile(s.filePath+hintSuffix, data, perm)
+}
+
+// loadHint fills the index of the segment from its hint file. The hint is
+// rejected if it doesn't match the checksum or the current segment size.
+func (s *Segment) loadHint() error {
+	data, err := os.ReadFile(s.filePath + hintSuffix)
+	if err != nil {
+		return err
+	}
+	stat, err := os.Stat(s.filePath)
+	if err != nil {
+		return err
+	}
+
+	if len(data) < 16+sumSize {
+		return errBadHint
+	}
+	sum := sha1.Sum(data[:len(data)-sumSize])
+	if !bytes.Equal(sum[:], data[len(data)-sumSize:]) {
+		return errBadHint
+	}
+	size := int64(binary.LittleEndian.Uint64(data))
+	if size != stat.Size() {
+		return errBadHint
+	}
+
+	index := make(hashIndex)
+	tombstones := make(map[string]struct{})
+	version := int64(binary.LittleEndian.Uint64(data[8:]))
+	data = data[16 : len(data)-sumSize]
+	for len(data) > 0 {
+		if len(data) < 4 {
+			return errBadHint
+		}
+		kl := int(binary.LittleEndian.Uint32(data))
+		if len(data) < 4+kl+8+4+1 {
+			return errBadHint
+		}
+		key := string(data[4 : 4+kl])
+		position := int64(binary.LittleEndian.Uint64(data[4+kl:]))
+		recordSize := int64(binary.LittleEndian.Uint32(data[4+kl+8:]))
+		flags := data[4+kl+12]
+		if position < 0 || position+recordSize > size {
+			return errBadHint
+		}
+		index[key] = position
+		if flags&flagDeleted != 0 {
+			tombstones[key] = struct{}{}
+		}
+		data = data[4+kl+13:]
+	}
+
+	s.mu.Lock()
+	s.index = index
+	s.tombstones = tombstones
+	s.version = version
+	s.mu.Unlock()
+	return nil
+}
@@ -0,0 +1,80 @@
+package datastore
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestDb_Hints(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDb(dir, 120)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Put("key1", "value1")
+	db.Delete("key2")
+	db.Put("key3", "value3")
+	assertSegmentsCount(t, db, 2)
+	sealed := db.segmentList()[0].filePath
+	db.Close()
+
+	if _, err := os.Stat(sealed + hintSuffix); err != nil {
+		t.Fatalf("Sealed segment has no hint: %s", err)
+	}
+	if _, err := os.Stat(db.outPath + hintSuffix); !os.IsNotExist(err) {
+		t.Errorf("Active segment has a hint: %v", err)
+	}
+
+	// Damage a value without changing the size. The segment is not read on
+	// open while its hint is valid, so only the lookup notices.
+	data, err := ioutil.ReadFile(sealed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data[headerSize+len("key1")] ^= 0xff
+	if err := ioutil.WriteFile(sealed, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("loads hint", func(t *testing.T) {
+		db, err := NewDb(dir, 120)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer db.Close()
+
+		if _, err := db.Get("key1"); !errors.Is(err, errChecksum) {
+			t.Errorf("Expected checksum error, got %v", err)
+		}
+		if _, err := db.Get("key2"); err != ErrNotFound {
+			t.Errorf("Expected ErrNotFound for deleted key, got %v", err)
+		}
+		value, err := db.Get("key3")
+		if err != nil {
+			t.Fatal(err)
+		}
+		assertEqual(t, value, "value3")
+	})
+
+	t.Run("falls back to a scan", func(t *testing.T) {
+		hint, err := ioutil.ReadFile(sealed + hintSuffix)
+		if err != nil {
+			t.Fatal(err)
+		}
+		hint[len(hint)-1] ^= 0xff
+		if err := ioutil.WriteFile(sealed+hintSuffix, hint, 0o600); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := NewDb(dir, 120); !errors.Is(err, ErrCorrupted) {
+			t.Errorf("Expected ErrCorrupted, got %v", err)
+		}
+	})
+}
@@ -0,0 +1,163 @@
+package datastore
+
+import (
+	"sort"
+	"strings"
+)
+
+// Iterator walks over the newest values of the keys that existed when it was
+// created, in key order. Deleted keys are skipped. Values are read from the
+// segment files lazily, one key at a time.
+type Iterator struct {
+	segments  []*Segment
+	keys      []string
+	positions []KeyPosition
+	i         int
+	key       string
+	entry     *entry
+	err       error
+}
+
+// Iterator returns an iterator over the keys that start with prefix. Call
+// Next before reading the first key and Close when stopping early.
+func (db *Db) Iterator(prefix string) *Iterator {
+	segments := db.acquireSegments()
+	return newIterator(segments, segments, prefix)
+}
+
+// newIterator returns an iterator over the keys of segments. The held
+// segments are acquired for the iterator and released by Close.
+func newIterator(segments, held []*Segment, prefix string) *Iterator {
+	positions := livePositions(segments, prefix)
+	it := &Iterator{
+		segments:  held,
+		keys:      make([]string, 0, len(positions)),
+		positions: make([]KeyPosition, 0, len(positions)),
+	}
+	for key := range positions {
+		it.keys = append(it.keys, key)
+	}
+	sort.Strings(it.keys)
+	for _, key := range it.keys {
+		it.positions = append(it.positions, positions[key])
+	}
+	return it
+}
+
+// Seek moves the iterator so that the next call to Next stops at the first
+// key that is not less than key.
+func (it *Iterator) Seek(key string) {
+	it.i = sort.SearchStrings(it.keys, key)
+}
+
+// Next reads the next key and reports whether there is one. It returns false
+// at the end of the keys or on error; see Err.
+func (it *Iterator) Next() bool {
+	it.key, it.entry = "", nil
+	for it.err == nil && it.i < len(it.keys) {
+		key, pos := it.keys[it.i], it.positions[it.i]
+		it.i++
+
+		e, err := pos.segment.getFromSegment(pos.position)
+		if err == ErrNotFound {
+			continue
+		}
+		if err != nil {
+			it.err = err
+			return false
+		}
+		it.key, it.entry = key, e
+		return true
+	}
+	it.Close()
+	return false
+}
+
+// Close releases the segments held by the iterator. It is called by Next at
+// the end of the keys.
+func (it *Iterator) Close() {
+	releaseSegments(it.segments)
+	it.segments = nil
+}
+
+func (it *Iterator) Key() string {
+	return it.key
+}
+
+// Value returns the raw bytes of the current value as a string; see Type.
+func (it *Iterator) Value() string {
+	if it.entry == nil {
+		return ""
+	}
+	return it.entry.value
+}
+
+func (it *Iterator) Type() ValueType {
+	if it.entry == nil {
+		return 0
+	}
+	return it.entry.vtype
+}
+
+// Int64 decodes the current value when it is of TypeInt64.
+func (it *Iterator) Int64() (int64, error) {
+	if it.entry == nil || it.entry.vtype != TypeInt64 {
+		return 0, ErrWrongType
+	}
+	return decodeInt64(it.entry.value)
+}
+
+func (it *Iterator) Err() error {
+	return it.err
+}
+
+// Keys returns all keys of the store in sorted order. Keys whose values have
+// expired are listed until compaction drops them.
+func (db *Db) Keys() []string {
+	segments := db.acquireSegments()
+	defer releaseSegments(segments)
+	positions := livePositions(segments, "")
+	keys := make([]string, 0, len(positions))
+	for key := range positions {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Scan calls fn for every key that starts with prefix, in key order, until fn
+// returns false.
+func (db *Db) Scan(prefix string, fn func(k, v string) bool) error {
+	it := db.Iterator(prefix)
+	defer it.Close()
+	for it.Next() {
+		if !fn(it.Key(), it.Value()) {
+			break
+		}
+	}
+	return it.Err()
+}
+
+// livePositions finds the newest record of every live key that starts with
+// prefix by walking the segments from the newest to the oldest. Segments
+// that can't be read are skipped.
+func livePositions(segments []*Segment, prefix string) map[string]KeyPosition {
+	seen := make(map[string]struct{})
+	positions := make(map[string]KeyPosition)
+	for i := range segments {
+		s := segments[len(segments)-i-1]
+		_ = s.each(func(key string, position int64, deleted bool) {
+			if !strings.HasPrefix(key, prefix) {
+				return
+			}
+			if _, ok := seen[key]; ok {
+				return
+			}
+			seen[key] = struct{}{}
+			if !deleted {
+				positions[key] = KeyPosition{segment: s, position: position}
+			}
+		})
+	}
+	return positions
+}
@@ -0,0 +1,69 @@
+package datastore
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestDb_Scan(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDb(dir, 250)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	db.Put("user/2", "old")
+	db.Put("user/1", "alice")
+	db.Put("group/1", "admins")
+	db.Put("user/3", "carol")
+	db.Put("user/2", "bob")
+	db.Delete("user/3")
+	db.PutInt64("user/count", 2)
+	assertSegmentsCount(t, db, 2)
+
+	t.Run("keys", func(t *testing.T) {
+		keys := db.Keys()
+		assertEqual(t, strings.Join(keys, ","), "group/1,user/1,user/2,user/count")
+	})
+
+	t.Run("prefix", func(t *testing.T) {
+		var got []string
+		err := db.Scan("user/", func(k, v string) bool {
+			got = append(got, k+"="+v)
+			return len(got) < 2
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		assertEqual(t, strings.Join(got, ","), "user/1=alice,user/2=bob")
+	})
+
+	t.Run("iterator", func(t *testing.T) {
+		it := db.Iterator("user/")
+		it.Seek("user/10")
+		if !it.Next() {
+			t.Fatal(it.Err())
+		}
+		assertEqual(t, it.Key(), "user/2")
+		if !it.Next() {
+			t.Fatal(it.Err())
+		}
+		assertEqual(t, it.Type(), TypeInt64)
+		count, err := it.Int64()
+		if err != nil {
+			t.Fatal(err)
+		}
+		assertEqual(t, count, int64(2))
+		if it.Next() {
+			t.Errorf("Unexpected key %s", it.Key())
+		}
+	})
+}
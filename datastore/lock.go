@@ -0,0 +1,28 @@
+package datastore
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+)
+
+// The LOCK file in the store directory is locked for as long as the store is
+// open: exclusively by a writer, shared by read-only users. A second writer,
+// or a writer and a reader, can't use the same directory at once.
+const lockName = "LOCK"
+
+var ErrLocked = errors.New("database is locked by another user")
+
+// lockDir locks the store directory. The lock is released by closing the
+// returned file.
+func lockDir(dir string, exclusive bool, perm os.FileMode) (*os.File, error) {
+	f, err := os.OpenFile(filepath.Join(dir, lockName), os.O_RDONLY|os.O_CREATE, perm)
+	if err != nil {
+		return nil, err
+	}
+	if err := lockFile(f, exclusive); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
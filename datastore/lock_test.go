@@ -0,0 +1,97 @@
+//go:build unix
+
+package datastore
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestDb_Lock(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDb(dir, 85)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"a1", "a2", "b1"} {
+		if err := db.Put(key, "value-"+key); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	t.Run("writer is exclusive", func(t *testing.T) {
+		if _, err := Open(dir); !errors.Is(err, ErrLocked) {
+			t.Errorf("Expected ErrLocked for a second writer, got %v", err)
+		}
+		if _, err := OpenReadOnly(dir); !errors.Is(err, ErrLocked) {
+			t.Errorf("Expected ErrLocked for a reader, got %v", err)
+		}
+	})
+
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	files, err := SegmentFiles(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("readers share the store", func(t *testing.T) {
+		r1, err := OpenReadOnly(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer r1.Close()
+		r2, err := OpenReadOnly(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer r2.Close()
+
+		value, err := r2.Get("b1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		assertEqual(t, value, "value-b1")
+		var keys []string
+		err = r1.Scan("a", func(k, v string) bool {
+			keys = append(keys, k)
+			return true
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(keys) != 2 || keys[0] != "a1" || keys[1] != "a2" {
+			t.Errorf("Unexpected keys %v", keys)
+		}
+
+		if _, err := Open(dir); !errors.Is(err, ErrLocked) {
+			t.Errorf("Expected ErrLocked for a writer, got %v", err)
+		}
+	})
+
+	t.Run("readers don't create segments", func(t *testing.T) {
+		after, err := SegmentFiles(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(after) != len(files) {
+			t.Errorf("Expected %d segments, got %d", len(files), len(after))
+		}
+	})
+
+	t.Run("lock is released on close", func(t *testing.T) {
+		db, err := Open(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		db.Close()
+	})
+}
@@ -0,0 +1,112 @@
+package datastore
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// The MANIFEST file lists the live segments of the store, oldest first, one
+// file name per line. If the oldest segment was written by a compaction, the
+// highest record version it merged comes next. Then comes the highest record
+// version assigned so far, followed by a line with the hex SHA1 sum of the
+// lines above. It is replaced atomically whenever the segment set changes, so
+// after a crash the store is opened with either the old or the new set.
+// Segment files it doesn't list are leftovers of interrupted compactions.
+const (
+	manifestName        = "MANIFEST"
+	manifestTemp        = manifestName + ".tmp"
+	manifestSumID       = "sha1 "
+	manifestVersionID   = "version "
+	manifestCompactedID = "compacted "
+)
+
+// writeManifest atomically replaces the manifest with the given segments.
+func writeManifest(dir string, segments []*Segment, version int64, perm os.FileMode) error {
+	var buf bytes.Buffer
+	for _, s := range segments {
+		buf.WriteString(filepath.Base(s.filePath))
+		buf.WriteByte('\n')
+	}
+	if len(segments) > 0 && segments[0].table != nil {
+		buf.WriteString(manifestCompactedID + strconv.FormatInt(segments[0].version, 10) + "\n")
+	}
+	buf.WriteString(manifestVersionID + strconv.FormatInt(version, 10) + "\n")
+	sum := sha1.Sum(buf.Bytes())
+	buf.WriteString(manifestSumID + hex.EncodeToString(sum[:]) + "\n")
+
+	tmpPath := filepath.Join(dir, manifestTemp)
+	f, err := os.OpenFile(tmpPath, os.O_TRUNC|os.O_WRONLY|os.O_CREATE, perm)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(buf.Bytes()); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpPath, filepath.Join(dir, manifestName)); err != nil {
+		return err
+	}
+	return syncDir(dir)
+}
+
+// readManifest returns the segment file names listed in the manifest, the
+// recorded version and the highest version merged into the oldest segment.
+// Versions are zero for manifests written before they existed. It returns an
+// error satisfying os.IsNotExist if the store has no manifest.
+func readManifest(dir string) (names []string, version, compacted int64, err error) {
+	data, err := os.ReadFile(filepath.Join(dir, manifestName))
+	if err != nil {
+		return nil, 0, 0, err
+	}
+
+	lines := strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+	last := lines[len(lines)-1]
+	if !strings.HasPrefix(last, manifestSumID) {
+		return nil, 0, 0, fmt.Errorf("%w: manifest has no checksum", ErrCorrupted)
+	}
+	body := data[:len(data)-len(last)-1]
+	sum := sha1.Sum(body)
+	if strings.TrimPrefix(last, manifestSumID) != hex.EncodeToString(sum[:]) {
+		return nil, 0, 0, fmt.Errorf("%w: manifest checksum mismatch", ErrCorrupted)
+	}
+
+	names = lines[:len(lines)-1]
+	if n := len(names); n > 0 && strings.HasPrefix(names[n-1], manifestVersionID) {
+		version, err = strconv.ParseInt(strings.TrimPrefix(names[n-1], manifestVersionID), 10, 64)
+		if err != nil {
+			return nil, 0, 0, fmt.Errorf("%w: bad manifest version: %s", ErrCorrupted, err)
+		}
+		names = names[:n-1]
+	}
+	if n := len(names); n > 0 && strings.HasPrefix(names[n-1], manifestCompactedID) {
+		compacted, err = strconv.ParseInt(strings.TrimPrefix(names[n-1], manifestCompactedID), 10, 64)
+		if err != nil {
+			return nil, 0, 0, fmt.Errorf("%w: bad compacted version: %s", ErrCorrupted, err)
+		}
+		names = names[:n-1]
+	}
+	return names, version, compacted, nil
+}
+
+// syncDir makes renames and removals in dir durable.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
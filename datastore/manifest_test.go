@@ -0,0 +1,121 @@
+package datastore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDb_Manifest(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := Open(dir, WithSegmentSize(85), WithCompaction(CompactionPolicy{Disabled: true}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i <= 5; i++ {
+		db.Put(fmt.Sprintf("key%d", i), fmt.Sprintf("value%d", i))
+	}
+	if err := db.Compact(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	assertSegmentsCount(t, db, 2)
+	live := []string{db.segmentList()[0].filePath, db.segmentList()[1].filePath}
+	db.Close()
+
+	t.Run("lists live segments", func(t *testing.T) {
+		paths, err := SegmentFiles(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assertEqual(t, fmt.Sprint(paths), fmt.Sprint(live))
+
+		files, err := segmentFiles(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assertEqual(t, len(files), 2)
+	})
+
+	t.Run("removes unlisted files", func(t *testing.T) {
+		leftover := filepath.Join(dir, fmt.Sprintf("%s%d", outFileName, 100))
+		e := entry{key: "key1", value: "stale", vtype: TypeString}
+		if err := ioutil.WriteFile(leftover, e.Encode(), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(leftover+compactSuffix, []byte("partial"), 0o600); err != nil {
+			t.Fatal(err)
+		}
+
+		db, err := NewDb(dir, 85)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer db.Close()
+
+		value, err := db.Get("key1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		assertEqual(t, value, "value1")
+		for _, path := range []string{leftover, leftover + compactSuffix} {
+			if _, err := os.Stat(path); !os.IsNotExist(err) {
+				t.Errorf("Leftover %s was not removed: %v", path, err)
+			}
+		}
+		assertEqual(t, db.lastSegmentIndex, 101)
+	})
+
+	t.Run("rejects a damaged manifest", func(t *testing.T) {
+		path := filepath.Join(dir, manifestName)
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data[0] ^= 0xff
+		if err := ioutil.WriteFile(path, data, 0o600); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := NewDb(dir, 85); !errors.Is(err, ErrCorrupted) {
+			t.Errorf("Expected ErrCorrupted, got %v", err)
+		}
+	})
+}
+
+func TestSegment_Retire(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s := newSegment(filepath.Join(dir, outFileName+"0"))
+	if err := ioutil.WriteFile(s.filePath, nil, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	if !s.acquire() {
+		t.Fatal("Cannot acquire a live segment")
+	}
+	s.retire()
+	if _, err := os.Stat(s.filePath); err != nil {
+		t.Errorf("Segment was removed while in use: %s", err)
+	}
+
+	s.release()
+	if _, err := os.Stat(s.filePath); !os.IsNotExist(err) {
+		t.Errorf("Retired segment was not removed: %v", err)
+	}
+	if s.acquire() {
+		t.Error("Acquired a removed segment")
+	}
+}
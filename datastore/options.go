@@ -0,0 +1,144 @@
+package datastore
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"time"
+)
+
+const (
+	// DefaultSegmentSize is the segment size of a store opened without
+	// WithSegmentSize.
+	DefaultSegmentSize = 10 * 1024 * 1024
+	// DefaultFileMode is the permission of the files created by the store.
+	DefaultFileMode os.FileMode = 0o644
+)
+
+var (
+	// ErrInvalidOption is wrapped by every OptionError.
+	ErrInvalidOption = errors.New("invalid option")
+	ErrReadOnly      = errors.New("database is opened read-only")
+)
+
+// OptionError reports an option Open can't open the store with.
+type OptionError struct {
+	Option string
+	Reason string
+}
+
+func (e *OptionError) Error() string {
+	return fmt.Sprintf("invalid option %s: %s", e.Option, e.Reason)
+}
+
+func (e *OptionError) Unwrap() error {
+	return ErrInvalidOption
+}
+
+// Options configures a Db. Zero fields take their defaults.
+type Options struct {
+	// SegmentSize is the size in bytes after which the active segment is
+	// sealed and a new one is started. Zero means DefaultSegmentSize.
+	SegmentSize int64
+	// FileMode is the permission of the segment, hint, filter and manifest
+	// files. Zero means DefaultFileMode.
+	FileMode os.FileMode
+	// Sync tells when written records are flushed to disk.
+	Sync SyncMode
+	// SyncInterval is the flush period for SyncInterval mode.
+	SyncInterval time.Duration
+	// Repair allows opening a store with damaged segments. Records after
+	// the damage are dropped and the active segment is truncated to its last
+	// intact record. See Db.RecoveryReport.
+	Repair bool
+	// Compaction tells when sealed segments are merged in the background.
+	Compaction CompactionPolicy
+	// Logger receives the errors of background work. Nil means the standard
+	// logger.
+	Logger *log.Logger
+	// ReadOnly opens the store without changing its files. Writes and
+	// compactions fail with ErrReadOnly.
+	ReadOnly bool
+}
+
+// Option changes a setting of the store opened by Open.
+type Option func(*Options)
+
+func WithSegmentSize(size int64) Option {
+	return func(o *Options) { o.SegmentSize = size }
+}
+
+func WithFileMode(mode os.FileMode) Option {
+	return func(o *Options) { o.FileMode = mode }
+}
+
+// WithSync sets the sync mode. SyncInterval mode is set by WithSyncInterval.
+func WithSync(mode SyncMode) Option {
+	return func(o *Options) { o.Sync = mode }
+}
+
+// WithSyncInterval flushes written records every period.
+func WithSyncInterval(period time.Duration) Option {
+	return func(o *Options) {
+		o.Sync = SyncInterval
+		o.SyncInterval = period
+	}
+}
+
+func WithRepair() Option {
+	return func(o *Options) { o.Repair = true }
+}
+
+func WithCompaction(policy CompactionPolicy) Option {
+	return func(o *Options) { o.Compaction = policy }
+}
+
+// WithLogger sends the errors of background work to logger. A logger
+// writing to io.Discard silences them.
+func WithLogger(logger *log.Logger) Option {
+	return func(o *Options) { o.Logger = logger }
+}
+
+func WithReadOnly() Option {
+	return func(o *Options) { o.ReadOnly = true }
+}
+
+// withDefaults fills the zero fields and checks the settings.
+func (o Options) withDefaults() (Options, error) {
+	if o.SegmentSize == 0 {
+		o.SegmentSize = DefaultSegmentSize
+	}
+	if o.FileMode == 0 {
+		o.FileMode = DefaultFileMode
+	}
+	if o.Logger == nil {
+		o.Logger = log.Default()
+	}
+
+	if o.SegmentSize < 0 {
+		return o, &OptionError{"segment size", fmt.Sprintf("must be positive, got %d", o.SegmentSize)}
+	}
+	if o.FileMode&^os.ModePerm != 0 {
+		return o, &OptionError{"file mode", fmt.Sprintf("must hold permission bits only, got %s", o.FileMode)}
+	}
+	if o.FileMode&0o600 != 0o600 {
+		return o, &OptionError{"file mode", fmt.Sprintf("must let the owner read and write, got %s", o.FileMode)}
+	}
+	switch o.Sync {
+	case SyncNever, SyncAlways:
+	case SyncInterval:
+		if o.SyncInterval <= 0 {
+			return o, &OptionError{"sync interval", fmt.Sprintf("must be positive, got %s", o.SyncInterval)}
+		}
+	default:
+		return o, &OptionError{"sync", fmt.Sprintf("unknown mode %d", o.Sync)}
+	}
+	if err := o.Compaction.validate(); err != nil {
+		return o, err
+	}
+	if o.ReadOnly && o.Repair {
+		return o, &OptionError{"repair", "a read-only store can't be repaired"}
+	}
+	return o, nil
+}
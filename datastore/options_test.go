@@ -0,0 +1,110 @@
+package datastore
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+func TestOpen_Options(t *testing.T) {
+	t.Run("invalid options", func(t *testing.T) {
+		invalid := map[string][]Option{
+			"segment size":  {WithSegmentSize(-1)},
+			"file mode":     {WithFileMode(0o400)},
+			"sync":          {WithSync(SyncMode(42))},
+			"sync interval": {WithSyncInterval(0)},
+			"compaction":    {WithCompaction(CompactionPolicy{DeadRatio: 2})},
+			"repair":        {WithReadOnly(), WithRepair()},
+		}
+		for name, opts := range invalid {
+			_, err := Open("", opts...)
+			var optErr *OptionError
+			if !errors.As(err, &optErr) || !errors.Is(err, ErrInvalidOption) {
+				t.Errorf("%s: expected an option error, got %v", name, err)
+			}
+		}
+	})
+
+	t.Run("file mode", func(t *testing.T) {
+		dir, err := ioutil.TempDir("", "test-db")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+
+		umask := syscall.Umask(0)
+		defer syscall.Umask(umask)
+
+		db, err := Open(dir, WithSegmentSize(85), WithFileMode(0o600))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer db.Close()
+		for _, name := range []string{outFileName + "0", manifestName} {
+			stat, err := os.Stat(filepath.Join(dir, name))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if stat.Mode().Perm() != 0o600 {
+				t.Errorf("%s has mode %s, expected 0600", name, stat.Mode().Perm())
+			}
+		}
+	})
+
+	t.Run("read-only", func(t *testing.T) {
+		dir, err := ioutil.TempDir("", "test-db")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+
+		db, err := NewDb(dir, 85)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, key := range []string{"key1", "key2", "key3"} {
+			if err := db.Put(key, "value"); err != nil {
+				t.Fatal(err)
+			}
+		}
+		db.Close()
+		before, err := os.ReadDir(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		db, err = Open(dir, WithReadOnly())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer db.Close()
+		value, err := db.Get("key2")
+		if err != nil {
+			t.Fatal(err)
+		}
+		assertEqual(t, value, "value")
+		if err := db.Put("key4", "value"); !errors.Is(err, ErrReadOnly) {
+			t.Errorf("Expected ErrReadOnly on put, got %v", err)
+		}
+		var b Batch
+		b.Put("key4", "value")
+		if err := db.Write(&b); !errors.Is(err, ErrReadOnly) {
+			t.Errorf("Expected ErrReadOnly on batch, got %v", err)
+		}
+		if err := db.Compact(context.Background()); !errors.Is(err, ErrReadOnly) {
+			t.Errorf("Expected ErrReadOnly on compaction, got %v", err)
+		}
+
+		after, err := os.ReadDir(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(after) != len(before) {
+			t.Errorf("Read-only store changed the directory: %d files before, %d after", len(before), len(after))
+		}
+	})
+}
@@ -0,0 +1,240 @@
+package datastore
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+var ErrCorrupted = errors.New("segment is corrupted")
+
+// RecoveryReport describes the damage found while opening the store.
+type RecoveryReport struct {
+	BadRecords []BadRecord
+	// BytesDropped is the number of bytes after the damage that were not
+	// recovered, including the bytes truncated from the active segment.
+	BytesDropped int64
+}
+
+// BadRecord points to the first damaged record of a segment.
+type BadRecord struct {
+	Segment string
+	Offset  int64
+	Reason  string
+}
+
+func (r RecoveryReport) Clean() bool {
+	return len(r.BadRecords) == 0
+}
+
+// RecoveryReport returns the damage repaired when the store was opened.
+func (db *Db) RecoveryReport() RecoveryReport {
+	return db.report
+}
+
+// recover loads the segments listed in the manifest, oldest first, and
+// removes the files of segments it doesn't list. A store without a manifest
+// loads every segment file in the order of their numbers.
+func (db *Db) recover() error {
+	files, err := segmentFiles(db.dir)
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		db.lastSegmentIndex = file.index + 1
+	}
+
+	names, version, compacted, err := readManifest(db.dir)
+	if err == nil {
+		files, err = db.listedFiles(files, names)
+	}
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if !db.readOnly {
+		if err := removeLeftovers(db.dir); err != nil {
+			return err
+		}
+	}
+
+	for i, file := range files {
+		s := newSegment(filepath.Join(db.dir, file.name))
+		if table, err := readSparseIndex(s.filePath); err == nil {
+			s.table = table
+			if filter, err := readBloomFilter(s.filePath+bloomSuffix, table.end); err == nil {
+				s.filter = filter
+			}
+			db.segments = append(db.segments, s)
+			continue
+		}
+
+		if err := s.loadHint(); err == nil {
+			db.segments = append(db.segments, s)
+			continue
+		}
+
+		// Segments without a readable sparse index or hint are scanned in
+		// full, which also catches a damaged index or footer.
+		good, size, damage := s.recover()
+		if damage != nil {
+			if !db.repair {
+				return fmt.Errorf("%w: %s at offset %d: %s", ErrCorrupted, s.filePath, good, damage)
+			}
+			if err := db.repairSegment(s, good, size, damage, i == len(files)-1); err != nil {
+				return err
+			}
+		}
+		db.segments = append(db.segments, s)
+	}
+
+	// Versions of records in sorted segments are covered by the manifest.
+	if len(db.segments) > 0 && db.segments[0].table != nil {
+		db.segments[0].version = compacted
+	}
+	for _, s := range db.segments {
+		if s.version > version {
+			version = s.version
+		}
+	}
+	db.version.Store(version)
+	return nil
+}
+
+// listedFiles orders the segment files as listed in the manifest and removes
+// the files it doesn't list, unless the store is read-only.
+func (db *Db) listedFiles(files []segmentFile, names []string) ([]segmentFile, error) {
+	found := make(map[string]segmentFile)
+	for _, file := range files {
+		found[file.name] = file
+	}
+
+	listed := make([]segmentFile, 0, len(names))
+	for _, name := range names {
+		file, ok := found[name]
+		if !ok {
+			return nil, fmt.Errorf("%w: segment %s listed in the manifest is missing", ErrCorrupted, name)
+		}
+		delete(found, name)
+		listed = append(listed, file)
+	}
+
+	if db.readOnly {
+		return listed, nil
+	}
+	for name := range found {
+		newSegment(filepath.Join(db.dir, name)).removeFiles()
+	}
+	return listed, nil
+}
+
+// removeLeftovers removes unfinished compaction outputs and manifests.
+func removeLeftovers(dir string) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if strings.HasSuffix(e.Name(), compactSuffix) || e.Name() == manifestTemp {
+			if err := os.Remove(filepath.Join(dir, e.Name())); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// repairSegment records the damage of a segment in the report. The active
+// segment is truncated to its last intact record so that new records are
+// appended right after it; sealed segments are left as they are and their
+// damaged part is dropped on the next compaction.
+func (db *Db) repairSegment(s *Segment, good, size int64, damage error, active bool) error {
+	if active {
+		if err := os.Truncate(s.filePath, good); err != nil {
+			return err
+		}
+	}
+	db.report.BadRecords = append(db.report.BadRecords, BadRecord{
+		Segment: s.filePath,
+		Offset:  good,
+		Reason:  damage.Error(),
+	})
+	db.report.BytesDropped += size - good
+	return nil
+}
+
+// recover rebuilds the segment index by reading and verifying all of its
+// records. It returns the offset right after the last intact record and the
+// file size; damage describes why the rest of the file could not be read.
+func (s *Segment) recover() (good int64, size int64, damage error) {
+	file, err := os.Open(s.filePath)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer file.Close()
+
+	stat, err := file.Stat()
+	if err != nil {
+		return 0, 0, err
+	}
+	size = stat.Size()
+
+	in := bufio.NewReaderSize(file, bufSize)
+	r := RecordReader{in: in}
+	var offset int64
+	// Records of a batch that has not been committed yet. A batch
+	// interrupted by a crash never gets its commit record and is ignored.
+	type pendingKey struct {
+		key      string
+		position int64
+		deleted  bool
+	}
+	var pending []pendingKey
+
+	for {
+		if _, err := in.Peek(1); err == io.EOF {
+			return offset, size, nil
+		}
+
+		e, intact, err := r.next()
+		if err != nil {
+			return offset, size, err
+		}
+		if !intact {
+			return offset, size, errChecksum
+		}
+
+		switch {
+		case e.index || e.footer:
+			// The records before them are sorted and were already
+			// indexed as usual.
+		case e.commit:
+			count, err := decodeInt64(e.value)
+			if err != nil || count > int64(len(pending)) {
+				return offset, size, fmt.Errorf("bad batch commit record")
+			}
+			for _, p := range pending[len(pending)-int(count):] {
+				s.setKey(p.key, p.position, p.deleted)
+			}
+			pending = pending[:0]
+		case e.batched:
+			pending = append(pending, pendingKey{
+				key:      e.key,
+				position: offset,
+				deleted:  e.deleted,
+			})
+		default:
+			pending = pending[:0]
+			s.setKey(e.key, offset, e.deleted)
+		}
+		if e.version > s.version {
+			s.version = e.version
+		}
+		// Records written before the format version existed are shorter
+		// than they would be now.
+		offset = r.Offset()
+	}
+}
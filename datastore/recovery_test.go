@@ -0,0 +1,222 @@
+package datastore
+
+import (
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDb_RecoverTornTail(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDb(dir, 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Put("key1", "value1")
+	db.Put("key2", "value2")
+	path := db.outPath
+	db.Close()
+
+	good, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Simulate a crash in the middle of writing a record.
+	torn := entry{key: "key3", value: "value3", vtype: TypeString}
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write(torn.Encode()[:20])
+	f.Close()
+
+	t.Run("refuses to open without repair", func(t *testing.T) {
+		_, err := NewDb(dir, 1000)
+		if !errors.Is(err, ErrCorrupted) {
+			t.Errorf("Expected ErrCorrupted, got %v", err)
+		}
+	})
+
+	t.Run("truncates the tail with repair", func(t *testing.T) {
+		db, err := Open(dir, WithSegmentSize(1000), WithRepair())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer db.Close()
+
+		report := db.RecoveryReport()
+		if len(report.BadRecords) != 1 {
+			t.Fatalf("Expected 1 bad record, got %d", len(report.BadRecords))
+		}
+		assertEqual(t, report.BadRecords[0].Offset, good.Size())
+		assertEqual(t, report.BytesDropped, int64(20))
+
+		stat, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assertEqual(t, stat.Size(), good.Size())
+
+		value, _ := db.Get("key2")
+		assertEqual(t, value, "value2")
+		if err := db.Put("key3", "value3"); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("reopens clean after repair", func(t *testing.T) {
+		db, err := NewDb(dir, 1000)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer db.Close()
+
+		if !db.RecoveryReport().Clean() {
+			t.Errorf("Unexpected damage: %+v", db.RecoveryReport())
+		}
+		value, _ := db.Get("key3")
+		assertEqual(t, value, "value3")
+	})
+}
+
+func TestDb_RecoverBadChecksum(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDb(dir, 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Put("key1", "value1")
+	db.Put("key2", "value2")
+	db.Put("key3", "value3")
+	path := db.outPath
+	db.Close()
+
+	// Flip a byte of the second record value.
+	recordSize := (&entry{key: "key1", value: "value1", version: 1}).size()
+	f, err := os.OpenFile(path, os.O_RDWR, 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteAt([]byte{'X'}, recordSize+headerSize+versionSize+4)
+	f.Close()
+
+	if _, err := NewDb(dir, 1000); !errors.Is(err, ErrCorrupted) {
+		t.Errorf("Expected ErrCorrupted, got %v", err)
+	}
+
+	db, err = Open(dir, WithSegmentSize(1000), WithRepair())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	report := db.RecoveryReport()
+	if len(report.BadRecords) != 1 {
+		t.Fatalf("Expected 1 bad record, got %d", len(report.BadRecords))
+	}
+	assertEqual(t, report.BadRecords[0].Offset, recordSize)
+	assertEqual(t, report.BytesDropped, 2*recordSize)
+
+	value, _ := db.Get("key1")
+	assertEqual(t, value, "value1")
+	for _, key := range []string{"key2", "key3"} {
+		if _, err := db.Get(key); err != ErrNotFound {
+			t.Errorf("Expected ErrNotFound for %s, got %v", key, err)
+		}
+	}
+}
+
+// legacyRecord encodes a record the way stores did before the format version
+// existed.
+func legacyRecord(key, value string, deleted bool) []byte {
+	kl, vl := len(key), len(value)
+	res := make([]byte, legacyHeaderSize+kl+vl+sumSize)
+	binary.LittleEndian.PutUint32(res, uint32(len(res)))
+	binary.LittleEndian.PutUint32(res[4:], uint32(kl))
+	binary.LittleEndian.PutUint32(res[8:], uint32(vl))
+	if deleted {
+		binary.LittleEndian.PutUint32(res[8:], legacyTombstone)
+	}
+	copy(res[legacyHeaderSize:], key)
+	copy(res[legacyHeaderSize+kl:], value)
+	sum := sha1.Sum(res[:len(res)-sumSize])
+	copy(res[len(res)-sumSize:], sum[:])
+	return res
+}
+
+func TestDb_OpenLegacyRecords(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var data []byte
+	data = append(data, legacyRecord("key1", "value1", false)...)
+	data = append(data, legacyRecord("key2", "value2", false)...)
+	data = append(data, legacyRecord("key1", "", true)...)
+	data = append(data, legacyRecord("key3", "", false)...)
+	path := filepath.Join(dir, outFileName+"0")
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, opts := range [][]Option{{WithSegmentSize(1000)}, {WithSegmentSize(1000), WithRepair()}} {
+		db, err := Open(dir, opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !db.RecoveryReport().Clean() {
+			t.Errorf("Unexpected damage: %+v", db.RecoveryReport())
+		}
+		if _, err := db.Get("key1"); err != ErrNotFound {
+			t.Errorf("Expected ErrNotFound for key1, got %v", err)
+		}
+		value, _ := db.Get("key2")
+		assertEqual(t, value, "value2")
+		if value, err := db.Get("key3"); err != nil || value != "" {
+			t.Errorf("Expected an empty value for key3, got %q (%v)", value, err)
+		}
+		db.Close()
+
+		stat, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assertEqual(t, stat.Size(), int64(len(data)))
+	}
+
+	// New records are appended after the old ones.
+	db, err := NewDb(dir, 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put("key4", "value4"); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+	db, err = NewDb(dir, 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for key, want := range map[string]string{"key2": "value2", "key4": "value4"} {
+		value, _ := db.Get(key)
+		assertEqual(t, value, want)
+	}
+}
@@ -0,0 +1,40 @@
+package datastore
+
+import "fmt"
+
+// Version returns the sequence number of the last committed write.
+func (db *Db) Version() int64 {
+	return db.version.Load()
+}
+
+// Apply writes an event of another store with its sequence number, so that a
+// follower keeps the versions and the change feed of its leader. Events at or
+// below Version are already applied and skipped, so a follower can resume
+// the feed of its leader from Version after a restart. A store that applies
+// events must not take writes of its own.
+func (db *Db) Apply(e Event) error {
+	if e.Seq <= db.Version() {
+		return nil
+	}
+	en := entry{key: e.Key, version: e.Seq}
+	switch e.Type {
+	case EventPut:
+		if e.ValueType < TypeString || e.ValueType > TypeBytes {
+			return fmt.Errorf("cannot apply event %d with value type %s", e.Seq, e.ValueType)
+		}
+		en.value = e.Value
+		en.vtype = e.ValueType
+		if !e.ExpiresAt.IsZero() {
+			en.expires = e.ExpiresAt.UnixNano()
+		}
+	case EventDelete:
+		en.deleted = true
+	default:
+		return fmt.Errorf("cannot apply event %d of type %s", e.Seq, e.Type)
+	}
+	return db.submit(&writeOp{
+		entries:    []entry{en},
+		replicated: true,
+		done:       make(chan error),
+	})
+}
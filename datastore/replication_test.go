@@ -0,0 +1,110 @@
+package datastore
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestDb_Apply(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, name := range []string{"leader", "follower"} {
+		if err := os.Mkdir(filepath.Join(dir, name), 0o755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	leader, err := NewDb(filepath.Join(dir, "leader"), 200)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer leader.Close()
+	follower, err := NewDb(filepath.Join(dir, "follower"), 200)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer follower.Close()
+
+	if err := leader.Put("key", "value"); err != nil {
+		t.Fatal(err)
+	}
+	if err := leader.PutInt64("counter", 42); err != nil {
+		t.Fatal(err)
+	}
+	if err := leader.Delete("key"); err != nil {
+		t.Fatal(err)
+	}
+	if err := leader.PutWithTTL("temporary", "value", time.Hour); err != nil {
+		t.Fatal(err)
+	}
+
+	replicate := func(t *testing.T) {
+		t.Helper()
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		events, err := leader.WatchFrom(ctx, "", follower.Version())
+		if err != nil {
+			t.Fatal(err)
+		}
+		for follower.Version() < leader.Version() {
+			select {
+			case e := <-events:
+				if err := follower.Apply(e); err != nil {
+					t.Fatal(err)
+				}
+			case <-time.After(time.Second):
+				t.Fatalf("Follower stopped at %d of %d", follower.Version(), leader.Version())
+			}
+		}
+	}
+	replicate(t)
+
+	if _, err := follower.Get("key"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected the key to be deleted, got %v", err)
+	}
+	if counter, err := follower.GetInt64("counter"); err != nil || counter != 42 {
+		t.Errorf("Expected counter 42, got %d (%v)", counter, err)
+	}
+	item, err := follower.GetItem("temporary")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if item.Version != 4 || item.ExpiresAt.IsZero() {
+		t.Errorf("Expected the version and the expiry of the leader, got %+v", item)
+	}
+
+	t.Run("skips applied events", func(t *testing.T) {
+		if err := follower.Apply(Event{Seq: 1, Type: EventPut, Key: "key", Value: "stale", ValueType: TypeString}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := follower.Get("key"); !errors.Is(err, ErrNotFound) {
+			t.Errorf("Stale event was applied: %v", err)
+		}
+	})
+
+	t.Run("resumes after reopening", func(t *testing.T) {
+		follower.Close()
+		follower, err = NewDb(filepath.Join(dir, "follower"), 200)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer follower.Close()
+		if err := leader.Put("key", "again"); err != nil {
+			t.Fatal(err)
+		}
+		replicate(t)
+		value, err := follower.Get("key")
+		if err != nil {
+			t.Fatal(err)
+		}
+		assertEqual(t, value, "again")
+	})
+}
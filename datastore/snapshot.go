@@ -0,0 +1,124 @@
+package datastore
+
+import "sync"
+
+// Snapshot is a read view of the store as it was when the snapshot was
+// taken. Later writes don't show up in it and compaction keeps the files it
+// reads until it is closed.
+type Snapshot struct {
+	// segments are searched by lookups. The active segment is replaced by a
+	// copy of its index at the time of the snapshot.
+	segments []*Segment
+	// held are the segments acquired for the snapshot.
+	held []*Segment
+	// end is the size of the active segment covered by the snapshot, -1 for
+	// read-only stores where every file is covered in full.
+	end int64
+	// version is the highest record version in the snapshot.
+	version   int64
+	closeOnce sync.Once
+}
+
+// Snapshot returns a read view of the current state of the store. It must be
+// closed when no longer used.
+func (db *Db) Snapshot() *Snapshot {
+	if db.readOnly {
+		return db.takeSnapshot()
+	}
+	// The put routine takes the snapshot between writes, so that the active
+	// segment holds only complete writes and batches.
+	reply := make(chan *Snapshot)
+	select {
+	case db.snapshotOps <- reply:
+		return <-reply
+	case <-db.closing:
+		// Nothing changes the segments once the put routine is done.
+		db.writer.Wait()
+		return db.takeSnapshot()
+	}
+}
+
+func (db *Db) takeSnapshot() *Snapshot {
+	held := db.acquireSegments()
+	snap := &Snapshot{
+		segments: append([]*Segment(nil), held...),
+		held:     held,
+		end:      -1,
+		version:  db.version.Load(),
+	}
+	if db.readOnly || len(held) == 0 {
+		return snap
+	}
+
+	active := held[len(held)-1]
+	frozen := newSegment(active.filePath)
+	active.mu.Lock()
+	for key, position := range active.index {
+		frozen.index[key] = position
+	}
+	for key := range active.tombstones {
+		frozen.tombstones[key] = struct{}{}
+	}
+	active.mu.Unlock()
+	snap.segments[len(held)-1] = frozen
+	snap.end = db.outOffset
+	return snap
+}
+
+func (snap *Snapshot) Get(key string) (string, error) {
+	e, err := snap.getEntry(key, TypeString)
+	if err != nil {
+		return "", err
+	}
+	return e.value, nil
+}
+
+func (snap *Snapshot) GetInt64(key string) (int64, error) {
+	e, err := snap.getEntry(key, TypeInt64)
+	if err != nil {
+		return 0, err
+	}
+	return decodeInt64(e.value)
+}
+
+func (snap *Snapshot) GetBytes(key string) ([]byte, error) {
+	e, err := snap.getEntry(key, TypeBytes)
+	if err != nil {
+		return nil, err
+	}
+	return []byte(e.value), nil
+}
+
+func (snap *Snapshot) getEntry(key string, vtype ValueType) (*entry, error) {
+	s, position, err := findKey(snap.segments, key)
+	if err != nil {
+		return nil, err
+	}
+	e, err := s.getFromSegment(position)
+	if err != nil {
+		return nil, err
+	}
+	return checkType(e, vtype)
+}
+
+// Iterator returns an iterator over the keys of the snapshot that start with
+// prefix. It keeps working if the snapshot is closed before the iterator.
+func (snap *Snapshot) Iterator(prefix string) *Iterator {
+	// The segments are held by the snapshot, so acquiring them again only
+	// fails once it is closed.
+	held := make([]*Segment, 0, len(snap.held))
+	for _, s := range snap.held {
+		if !s.acquire() {
+			break
+		}
+		held = append(held, s)
+	}
+	return newIterator(snap.segments, held, prefix)
+}
+
+// Close releases the segments held by the snapshot.
+func (snap *Snapshot) Close() {
+	snap.closeOnce.Do(func() {
+		releaseSegments(snap.held)
+	})
+}
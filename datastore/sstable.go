@@ -0,0 +1,245 @@
+package datastore
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+)
+
+// Sorted segments written by compaction hold their records in key order,
+// followed by a sparse index record and a footer record:
+//
+//	records sorted by key
+//	index record: for every block, uint32 key size, first key, uint64 offset
+//	footer record: int64 offset of the index record
+//
+// Only the sparse index is kept in memory. A lookup picks the block that may
+// hold the key and scans it.
+const (
+	// tableBlockSize is the amount of record bytes covered by a single
+	// sparse index entry.
+	tableBlockSize = 4096
+	footerSize     = headerSize + 8 + sumSize
+)
+
+var errNotTable = errors.New("not a sorted segment")
+
+// sparseIndex holds the first key and offset of every block of a sorted
+// segment.
+type sparseIndex struct {
+	keys    []string
+	offsets []int64
+	// end is the offset of the index record, where the records end.
+	end int64
+}
+
+// block returns the byte range of the block that may hold the key.
+func (t *sparseIndex) block(key string) (start, end int64, ok bool) {
+	i := sort.SearchStrings(t.keys, key)
+	if i == len(t.keys) || t.keys[i] != key {
+		i--
+	}
+	if i < 0 {
+		return 0, 0, false
+	}
+	end = t.end
+	if i+1 < len(t.offsets) {
+		end = t.offsets[i+1]
+	}
+	return t.offsets[i], end, true
+}
+
+func (t *sparseIndex) encode() string {
+	var buf []byte
+	for i, key := range t.keys {
+		buf = binary.LittleEndian.AppendUint32(buf, uint32(len(key)))
+		buf = append(buf, key...)
+		buf = binary.LittleEndian.AppendUint64(buf, uint64(t.offsets[i]))
+	}
+	return string(buf)
+}
+
+func decodeSparseIndex(value string, end int64) (*sparseIndex, error) {
+	t := &sparseIndex{end: end}
+	data := []byte(value)
+	for len(data) > 0 {
+		if len(data) < 4 {
+			return nil, fmt.Errorf("bad sparse index entry")
+		}
+		kl := int(binary.LittleEndian.Uint32(data))
+		if len(data) < 4+kl+8 {
+			return nil, fmt.Errorf("bad sparse index entry")
+		}
+		t.keys = append(t.keys, string(data[4:4+kl]))
+		t.offsets = append(t.offsets, int64(binary.LittleEndian.Uint64(data[4+kl:])))
+		data = data[4+kl+8:]
+	}
+	return t, nil
+}
+
+// tableWriter writes a sorted segment. Records must be added in key order.
+type tableWriter struct {
+	f      *os.File
+	out    *bufio.Writer
+	index  sparseIndex
+	offset int64
+	block  int64
+}
+
+func newTableWriter(path string, perm os.FileMode) (*tableWriter, error) {
+	f, err := os.OpenFile(path, os.O_TRUNC|os.O_WRONLY|os.O_CREATE, perm)
+	if err != nil {
+		return nil, err
+	}
+	return &tableWriter{
+		f:     f,
+		out:   bufio.NewWriterSize(f, bufSize),
+		block: -1,
+	}, nil
+}
+
+func (w *tableWriter) add(e *entry) error {
+	if w.block < 0 || w.offset-w.block >= tableBlockSize {
+		w.index.keys = append(w.index.keys, e.key)
+		w.index.offsets = append(w.index.offsets, w.offset)
+		w.block = w.offset
+	}
+	n, err := w.out.Write(e.Encode())
+	w.offset += int64(n)
+	return err
+}
+
+// finish writes the sparse index and the footer, syncs and closes the file.
+func (w *tableWriter) finish() (*sparseIndex, error) {
+	defer w.f.Close()
+
+	w.index.end = w.offset
+	index := entry{value: w.index.encode(), vtype: TypeBytes, index: true}
+	footer := entry{value: encodeInt64(w.offset), vtype: TypeInt64, footer: true}
+	if _, err := w.out.Write(index.Encode()); err != nil {
+		return nil, err
+	}
+	if _, err := w.out.Write(footer.Encode()); err != nil {
+		return nil, err
+	}
+	if err := w.out.Flush(); err != nil {
+		return nil, err
+	}
+	if err := w.f.Sync(); err != nil {
+		return nil, err
+	}
+	return &w.index, w.f.Close()
+}
+
+// abort closes and removes an unfinished sorted segment.
+func (w *tableWriter) abort() {
+	w.f.Close()
+	os.Remove(w.f.Name())
+}
+
+// readSparseIndex loads the sparse index of a sorted segment. It returns
+// errNotTable for segments written by the put routine.
+func readSparseIndex(path string) (*sparseIndex, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	stat, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if stat.Size() < footerSize {
+		return nil, errNotTable
+	}
+
+	footer, err := readRecordAt(f, stat.Size()-footerSize)
+	if err != nil || !footer.footer {
+		return nil, errNotTable
+	}
+	end, err := decodeInt64(footer.value)
+	if err != nil || end < 0 || end >= stat.Size()-footerSize {
+		return nil, errNotTable
+	}
+
+	index, err := readRecordAt(f, end)
+	if err != nil || !index.index {
+		return nil, errNotTable
+	}
+	return decodeSparseIndex(index.value, end)
+}
+
+func readRecordAt(f *os.File, offset int64) (*entry, error) {
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		return nil, err
+	}
+	return readRecord(bufio.NewReader(f))
+}
+
+// find scans the block of the sorted segment that may hold the key.
+func (t *sparseIndex) find(path, key string) (position int64, deleted, ok bool, err error) {
+	start, end, ok := t.block(key)
+	if !ok {
+		return 0, false, false, nil
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, false, false, err
+	}
+	defer f.Close()
+	if _, err := f.Seek(start, io.SeekStart); err != nil {
+		return 0, false, false, err
+	}
+
+	r := RecordReader{in: bufio.NewReaderSize(io.LimitReader(f, end-start), bufSize)}
+	for {
+		offset := r.offset
+		e, intact, err := r.next()
+		if err == io.EOF {
+			return 0, false, false, nil
+		}
+		if err != nil {
+			return 0, false, false, err
+		}
+		if !intact {
+			return 0, false, false, errChecksum
+		}
+		if e.key == key {
+			return start + offset, e.deleted, true, nil
+		}
+		if e.key > key {
+			return 0, false, false, nil
+		}
+	}
+}
+
+// each calls fn for every record of the sorted segment.
+func (t *sparseIndex) each(path string, fn func(key string, position int64, deleted bool)) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	r := RecordReader{in: bufio.NewReaderSize(io.LimitReader(f, t.end), bufSize)}
+	for {
+		offset := r.offset
+		e, intact, err := r.next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if !intact {
+			return errChecksum
+		}
+		fn(e.key, offset, e.deleted)
+	}
+}
@@ -0,0 +1,130 @@
+package datastore
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSparseIndex(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, outFileName+"0")
+	w, err := newTableWriter(path, DefaultFileMode)
+	if err != nil {
+		t.Fatal(err)
+	}
+	value := strings.Repeat("v", 500)
+	for i := 0; i < 100; i++ {
+		e := entry{key: fmt.Sprintf("key%03d", i), value: value, vtype: TypeString}
+		if err := w.add(&e); err != nil {
+			t.Fatal(err)
+		}
+	}
+	written, err := w.finish()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	table, err := readSparseIndex(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(table.keys) < 2 {
+		t.Errorf("Expected several blocks, got %d", len(table.keys))
+	}
+	assertEqual(t, len(table.keys), len(written.keys))
+	assertEqual(t, table.end, written.end)
+
+	s := newSegment(path)
+	s.table = table
+	for _, key := range []string{"key000", "key042", "key099"} {
+		position, deleted, ok, err := s.lookup(key)
+		if err != nil || !ok || deleted {
+			t.Fatalf("Cannot find %s: %v", key, err)
+		}
+		e, err := s.getFromSegment(position)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assertEqual(t, e.key, key)
+	}
+	for _, key := range []string{"a", "key0420", "key100"} {
+		if _, _, ok, err := s.lookup(key); ok || err != nil {
+			t.Errorf("Unexpected result for missing key %s: %t, %v", key, ok, err)
+		}
+	}
+
+	t.Run("not a table", func(t *testing.T) {
+		db, err := NewDb(dir, 1000)
+		if err != nil {
+			t.Fatal(err)
+		}
+		db.Put("key", "value")
+		path := db.outPath
+		db.Close()
+
+		if _, err := readSparseIndex(path); err != errNotTable {
+			t.Errorf("Expected errNotTable, got %v", err)
+		}
+	})
+}
+
+func TestDb_SortedSegments(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := Open(dir, WithSegmentSize(85), WithCompaction(CompactionPolicy{Disabled: true}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Put("key3", "value3")
+	db.Put("key1", "value1")
+	db.Put("key2", "value2")
+	db.Put("key4", "value4")
+	db.Put("key5", "value5")
+	if err := db.Compact(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	assertSegmentsCount(t, db, 2)
+
+	sorted := db.segmentList()[0]
+	stat, err := os.Stat(sorted.filePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	index := entry{value: sorted.table.encode(), vtype: TypeBytes}
+	assertFileSize(t, stat, sorted.table.end+index.size()+footerSize)
+	db.Close()
+
+	db, err = Open(dir, WithSegmentSize(85), WithCompaction(CompactionPolicy{Disabled: true}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if db.segmentList()[0].table == nil {
+		t.Fatal("Sorted segment was not recognized on reopen")
+	}
+	if len(db.segmentList()[0].index) != 0 {
+		t.Error("Sorted segment keys were loaded into the hash index")
+	}
+	for _, key := range []string{"key1", "key2", "key3", "key4", "key5"} {
+		value, err := db.Get(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assertEqual(t, value, "value"+strings.TrimPrefix(key, "key"))
+	}
+	assertEqual(t, strings.Join(db.Keys(), ","), "key1,key2,key3,key4,key5")
+}
@@ -0,0 +1,78 @@
+package datastore
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestDb_PutWithTTL(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := Open(dir, WithSegmentSize(150), WithCompaction(CompactionPolicy{Disabled: true}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	if err := db.PutWithTTL("key", "value", 0); err == nil {
+		t.Error("Expected an error for zero ttl")
+	}
+
+	if err := db.PutWithTTL("short", "value", 50*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.PutWithTTL("long", "value", time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put("forever", "value"); err != nil {
+		t.Fatal(err)
+	}
+
+	value, expiresAt, err := db.GetWithExpiry("long")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, value, "value")
+	if until := time.Until(expiresAt); until <= 59*time.Minute || until > time.Hour {
+		t.Errorf("Unexpected expiry time %s", expiresAt)
+	}
+	if _, expiresAt, err := db.GetWithExpiry("forever"); err != nil || !expiresAt.IsZero() {
+		t.Errorf("Expected no expiry time, got %s (%v)", expiresAt, err)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	if _, err := db.Get("short"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected ErrNotFound for an expired key, got %v", err)
+	}
+	if _, err := db.Get("long"); err != nil {
+		t.Errorf("Cannot get a key that has not expired: %s", err)
+	}
+
+	t.Run("compaction drops expired keys", func(t *testing.T) {
+		// Seal the segment holding the keys.
+		for len(db.segmentList()) < 2 {
+			if err := db.Put("filler", "filler-value"); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := db.Compact(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+
+		segments := db.segmentList()
+		if _, _, ok, _ := segments[0].lookup("short"); ok {
+			t.Error("Expired key survived compaction")
+		}
+		if _, _, ok, _ := segments[0].lookup("long"); !ok {
+			t.Error("Compaction dropped a key that has not expired")
+		}
+	})
+}
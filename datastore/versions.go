@@ -0,0 +1,112 @@
+package datastore
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Every record written by the put routine gets the next version of a counter
+// of the store, so the version of a key grows with each write. Conditional
+// writes compare versions inside the put routine, where no other write can
+// come in between the check and the write.
+var (
+	ErrVersionMismatch = errors.New("version does not match")
+	ErrKeyExists       = errors.New("key already exists")
+)
+
+// GetVersioned returns a string value together with the version of the
+// record holding it. Records written before versions existed have version 0.
+func (db *Db) GetVersioned(key string) (string, int64, error) {
+	item, err := db.GetItem(key)
+	return item.Value, item.Version, err
+}
+
+// CompareAndSwap stores the value only if the key exists and its newest
+// record has the expected version, otherwise it returns ErrVersionMismatch.
+// It returns the version of the new record.
+func (db *Db) CompareAndSwap(key string, expectedVersion int64, value string) (int64, error) {
+	return db.putVersioned(entry{
+		key:   key,
+		value: value,
+		vtype: TypeString,
+		update: func(e *entry) error {
+			current, err := db.getAnyEntry(key)
+			if errors.Is(err, ErrNotFound) {
+				return fmt.Errorf("%w: %s does not exist", ErrVersionMismatch, key)
+			}
+			if err != nil {
+				return err
+			}
+			if current.version != expectedVersion {
+				return fmt.Errorf("%w: %s is at version %d", ErrVersionMismatch, key, current.version)
+			}
+			return nil
+		},
+	})
+}
+
+// PutIfExists stores the value only if the key exists, whatever its version,
+// otherwise it returns ErrVersionMismatch. It returns the version of the new
+// record.
+func (db *Db) PutIfExists(key, value string) (int64, error) {
+	return db.putVersioned(entry{
+		key:   key,
+		value: value,
+		vtype: TypeString,
+		update: func(e *entry) error {
+			_, err := db.getAnyEntry(key)
+			if errors.Is(err, ErrNotFound) {
+				return fmt.Errorf("%w: %s does not exist", ErrVersionMismatch, key)
+			}
+			return err
+		},
+	})
+}
+
+// PutIfAbsent stores the value only if the key doesn't exist, otherwise it
+// returns ErrKeyExists. Deleted and expired keys count as absent. It returns
+// the version of the new record.
+func (db *Db) PutIfAbsent(key, value string) (int64, error) {
+	return db.putIfAbsent(entry{key: key, value: value, vtype: TypeString})
+}
+
+// PutWithTTLIfAbsent is like PutIfAbsent for a value that expires after ttl.
+func (db *Db) PutWithTTLIfAbsent(key, value string, ttl time.Duration) (int64, error) {
+	if ttl <= 0 {
+		return 0, fmt.Errorf("ttl must be positive, got %s", ttl)
+	}
+	return db.putIfAbsent(entry{
+		key:     key,
+		value:   value,
+		vtype:   TypeString,
+		expires: time.Now().Add(ttl).UnixNano(),
+	})
+}
+
+// PutInt64IfAbsent is like PutIfAbsent for an int64 value.
+func (db *Db) PutInt64IfAbsent(key string, value int64) (int64, error) {
+	return db.putIfAbsent(entry{key: key, value: encodeInt64(value), vtype: TypeInt64})
+}
+
+// PutBytesIfAbsent is like PutIfAbsent for a bytes value.
+func (db *Db) PutBytesIfAbsent(key string, value []byte) (int64, error) {
+	return db.putIfAbsent(entry{key: key, value: string(value), vtype: TypeBytes})
+}
+
+// putIfAbsent writes the entry only if its key doesn't exist, whatever the
+// type of the existing value.
+func (db *Db) putIfAbsent(e entry) (int64, error) {
+	key := e.key
+	e.update = func(e *entry) error {
+		_, err := db.getAnyEntry(key)
+		if err == nil {
+			return fmt.Errorf("%w: %s", ErrKeyExists, key)
+		}
+		if errors.Is(err, ErrNotFound) {
+			return nil
+		}
+		return err
+	}
+	return db.putVersioned(e)
+}
@@ -0,0 +1,159 @@
+package datastore
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestDb_CompareAndSwap(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDb(dir, 200)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	if _, err := db.CompareAndSwap("key", 0, "value"); !errors.Is(err, ErrVersionMismatch) {
+		t.Errorf("Expected ErrVersionMismatch for a missing key, got %v", err)
+	}
+	v1, err := db.PutIfAbsent("key", "value1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.PutIfAbsent("key", "value2"); !errors.Is(err, ErrKeyExists) {
+		t.Errorf("Expected ErrKeyExists, got %v", err)
+	}
+
+	value, version, err := db.GetVersioned("key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, value, "value1")
+	assertEqual(t, version, v1)
+
+	v2, err := db.CompareAndSwap("key", v1, "value2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v2 <= v1 {
+		t.Errorf("Version did not grow: %d after %d", v2, v1)
+	}
+	if _, err := db.CompareAndSwap("key", v1, "value3"); !errors.Is(err, ErrVersionMismatch) {
+		t.Errorf("Expected ErrVersionMismatch for a stale version, got %v", err)
+	}
+	value, _ = db.Get("key")
+	assertEqual(t, value, "value2")
+
+	v3, err := db.PutIfExists("key", "value3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v3 <= v2 {
+		t.Errorf("Version did not grow: %d after %d", v3, v2)
+	}
+	if err := db.Delete("key"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.PutIfExists("key", "value4"); !errors.Is(err, ErrVersionMismatch) {
+		t.Errorf("Expected ErrVersionMismatch for a deleted key, got %v", err)
+	}
+	if _, err := db.PutIfAbsent("key", "value4"); err != nil {
+		t.Errorf("Cannot put a deleted key: %s", err)
+	}
+
+	t.Run("typed values", func(t *testing.T) {
+		if _, err := db.PutInt64IfAbsent("int", 1); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := db.PutInt64IfAbsent("int", 2); !errors.Is(err, ErrKeyExists) {
+			t.Errorf("Expected ErrKeyExists, got %v", err)
+		}
+		if _, err := db.PutBytesIfAbsent("int", []byte("x")); !errors.Is(err, ErrKeyExists) {
+			t.Errorf("Expected ErrKeyExists for a value of another type, got %v", err)
+		}
+		if n, _ := db.GetInt64("int"); n != 1 {
+			t.Errorf("Expected 1, got %d", n)
+		}
+		if _, err := db.PutBytesIfAbsent("bytes", []byte("x")); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := db.PutWithTTLIfAbsent("ttl", "value", time.Hour); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := db.PutWithTTLIfAbsent("ttl", "value", time.Hour); !errors.Is(err, ErrKeyExists) {
+			t.Errorf("Expected ErrKeyExists, got %v", err)
+		}
+		item, err := db.GetItem("ttl")
+		if err != nil || item.ExpiresAt.IsZero() {
+			t.Errorf("Expected a value with an expiry time, got %+v (%v)", item, err)
+		}
+	})
+
+	t.Run("concurrent swaps", func(t *testing.T) {
+		if err := db.Put("counter", "0"); err != nil {
+			t.Fatal(err)
+		}
+		var wg sync.WaitGroup
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for done := 0; done < 10; {
+					value, version, err := db.GetVersioned("counter")
+					if err != nil {
+						t.Error(err)
+						return
+					}
+					n, _ := strconv.Atoi(value)
+					_, err = db.CompareAndSwap("counter", version, strconv.Itoa(n+1))
+					if errors.Is(err, ErrVersionMismatch) {
+						continue
+					}
+					if err != nil {
+						t.Error(err)
+						return
+					}
+					done++
+				}
+			}()
+		}
+		wg.Wait()
+		value, _ := db.Get("counter")
+		assertEqual(t, value, "100")
+	})
+
+	t.Run("versions survive reopening", func(t *testing.T) {
+		if err := db.Compact(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		_, last, err := db.GetVersioned("counter")
+		if err != nil {
+			t.Fatal(err)
+		}
+		db.Close()
+
+		db, err = NewDb(dir, 200)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer db.Close()
+		v, err := db.PutIfAbsent("other", "value")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v <= last {
+			t.Errorf("Version %d was not greater than %d written before reopening", v, last)
+		}
+	})
+}
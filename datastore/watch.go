@@ -0,0 +1,282 @@
+package datastore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// watchBuffer is the number of events a watcher may fall behind the put
+// routine by. A watcher that falls further behind is dropped.
+const watchBuffer = 1024
+
+// ErrCompacted is returned by WatchFrom when writes after the requested
+// sequence number may have been dropped by a compaction. The reader has to
+// start over from a backup or from sequence number 0.
+var ErrCompacted = errors.New("changes are compacted")
+
+// EventType tells what kind of write an Event describes.
+type EventType int
+
+const (
+	EventPut EventType = iota + 1
+	EventDelete
+)
+
+func (t EventType) String() string {
+	switch t {
+	case EventPut:
+		return "put"
+	case EventDelete:
+		return "delete"
+	default:
+		return "unknown"
+	}
+}
+
+// Event describes a committed write. Seq is the version of the written
+// record, so events of the store are ordered by it.
+type Event struct {
+	Seq  int64
+	Type EventType
+	Key  string
+	// Value holds the raw bytes of the value of a put; see ValueType.
+	Value     string
+	ValueType ValueType
+	// ExpiresAt is the expiry time of a put with a TTL.
+	ExpiresAt time.Time
+}
+
+// watcher receives the events of the put routine for keys with its prefix.
+type watcher struct {
+	prefix string
+	live   chan Event
+}
+
+// Watch returns the events of writes committed from now on to keys that
+// start with prefix, in commit order. The channel is closed when ctx is done,
+// when the store is closed, or when the reader falls behind by more than
+// watchBuffer events; it can then resume with WatchFrom.
+func (db *Db) Watch(ctx context.Context, prefix string) <-chan Event {
+	w := db.addWatcher(prefix)
+	out := make(chan Event)
+	go db.forward(ctx, w, nil, 0, out)
+	return out
+}
+
+// WatchFrom is like Watch, but first replays the writes with sequence
+// numbers above from that are still in the segment files. A compaction drops
+// replaced and deleted records, so if it merged writes above from, the replay
+// would miss them and ErrCompacted is returned instead. From 0 the replay
+// holds every key of the store.
+func (db *Db) WatchFrom(ctx context.Context, prefix string, from int64) (<-chan Event, error) {
+	// The watcher is added before the snapshot, so no write falls between
+	// the replayed and the live events.
+	w := db.addWatcher(prefix)
+	snap := db.Snapshot()
+	defer snap.Close()
+
+	if compacted := snap.compacted(); from > 0 && from < compacted {
+		db.removeWatcher(w)
+		return nil, fmt.Errorf("%w: up to %d", ErrCompacted, compacted)
+	}
+	replay, err := snap.changes(prefix, from)
+	if err != nil {
+		db.removeWatcher(w)
+		return nil, err
+	}
+	out := make(chan Event)
+	go db.forward(ctx, w, replay, snap.version, out)
+	return out, nil
+}
+
+// forward sends the replayed events and then the live events newer than
+// after to out.
+func (db *Db) forward(ctx context.Context, w *watcher, replay []Event, after int64, out chan<- Event) {
+	defer close(out)
+	defer db.removeWatcher(w)
+
+	send := func(e Event) bool {
+		select {
+		case out <- e:
+			return true
+		case <-ctx.Done():
+			return false
+		case <-db.closing:
+			return false
+		}
+	}
+	for _, e := range replay {
+		if !send(e) {
+			return
+		}
+	}
+	for {
+		select {
+		case e, ok := <-w.live:
+			if !ok {
+				return
+			}
+			if e.Seq > after && !send(e) {
+				return
+			}
+		case <-ctx.Done():
+			return
+		case <-db.closing:
+			return
+		}
+	}
+}
+
+func (db *Db) addWatcher(prefix string) *watcher {
+	w := &watcher{prefix: prefix, live: make(chan Event, watchBuffer)}
+	db.watchMu.Lock()
+	db.watchers[w] = struct{}{}
+	db.watchMu.Unlock()
+	return w
+}
+
+// removeWatcher stops the events of the watcher and closes its channel.
+func (db *Db) removeWatcher(w *watcher) {
+	db.watchMu.Lock()
+	defer db.watchMu.Unlock()
+	if _, ok := db.watchers[w]; ok {
+		delete(db.watchers, w)
+		close(w.live)
+	}
+}
+
+// publish sends the events of the committed operations to the watchers. It
+// is called by the put routine, which must not wait for slow watchers, so
+// those are dropped instead.
+func (db *Db) publish(ops []*writeOp) {
+	db.watchMu.Lock()
+	defer db.watchMu.Unlock()
+	if len(db.watchers) == 0 {
+		return
+	}
+
+	for _, op := range ops {
+		if op.err != nil {
+			continue
+		}
+		for i := range op.entries {
+			e := newEvent(&op.entries[i])
+			for w := range db.watchers {
+				if !strings.HasPrefix(e.Key, w.prefix) {
+					continue
+				}
+				select {
+				case w.live <- e:
+				default:
+					delete(db.watchers, w)
+					close(w.live)
+				}
+			}
+		}
+	}
+}
+
+// Int64 decodes the value of a TypeInt64 put.
+func (e *Event) Int64() (int64, error) {
+	return decodeInt64(e.Value)
+}
+
+// SetInt64 makes the event a put of an int64 value.
+func (e *Event) SetInt64(value int64) {
+	e.Type = EventPut
+	e.Value = encodeInt64(value)
+	e.ValueType = TypeInt64
+}
+
+func newEvent(e *entry) Event {
+	if e.deleted {
+		return Event{Seq: e.version, Type: EventDelete, Key: e.key}
+	}
+	event := Event{Seq: e.version, Type: EventPut, Key: e.key, Value: e.value, ValueType: e.vtype}
+	if e.expires != 0 {
+		event.ExpiresAt = time.Unix(0, e.expires)
+	}
+	return event
+}
+
+// compacted returns the highest version merged by the compaction that wrote
+// the oldest segment of the snapshot, zero if there is none.
+func (snap *Snapshot) compacted() int64 {
+	if len(snap.held) == 0 || snap.held[0].table == nil {
+		return 0
+	}
+	return snap.held[0].version
+}
+
+// changes reads the events of the snapshot with sequence numbers above from,
+// ordered by sequence number.
+func (snap *Snapshot) changes(prefix string, from int64) ([]Event, error) {
+	var events []Event
+	for i, s := range snap.held {
+		limit := int64(-1)
+		if s.table != nil {
+			limit = s.table.end
+		} else if i == len(snap.held)-1 {
+			limit = snap.end
+		}
+		err := segmentChanges(s.filePath, limit, s.table != nil, func(e *entry) {
+			if e.version > from && e.version <= snap.version && strings.HasPrefix(e.key, prefix) {
+				events = append(events, newEvent(e))
+			}
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	sort.Slice(events, func(i, j int) bool {
+		return events[i].Seq < events[j].Seq
+	})
+	return events, nil
+}
+
+// segmentChanges calls fn for the committed records among the first limit
+// bytes of the segment file, or the whole file if limit is negative. Sorted
+// segments hold committed records only. Reading stops at damaged records.
+func segmentChanges(path string, limit int64, sorted bool, fn func(e *entry)) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var in io.Reader = f
+	if limit >= 0 {
+		in = io.LimitReader(f, limit)
+	}
+	r := NewRecordReader(in)
+	var pending []*entry
+	for {
+		e, intact, err := r.next()
+		if err != nil || !intact {
+			return nil
+		}
+		switch {
+		case e.index || e.footer:
+		case e.commit:
+			count, err := decodeInt64(e.value)
+			if err != nil || count > int64(len(pending)) {
+				return nil
+			}
+			for _, p := range pending[len(pending)-int(count):] {
+				fn(p)
+			}
+			pending = pending[:0]
+		case e.batched && !sorted:
+			pending = append(pending, e)
+		default:
+			pending = pending[:0]
+			fn(e)
+		}
+	}
+}
@@ -0,0 +1,156 @@
+package datastore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestDb_Watch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := Open(dir, WithSegmentSize(200), WithCompaction(CompactionPolicy{Disabled: true}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { db.Close() }()
+
+	next := func(t *testing.T, events <-chan Event) Event {
+		t.Helper()
+		select {
+		case e, ok := <-events:
+			if !ok {
+				t.Fatal("Events channel closed")
+			}
+			return e
+		case <-time.After(time.Second):
+			t.Fatal("No event received")
+		}
+		return Event{}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	events := db.Watch(ctx, "a")
+
+	if err := db.Put("a1", "value1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put("b1", "ignored"); err != nil {
+		t.Fatal(err)
+	}
+	var b Batch
+	b.Put("a2", "value2")
+	b.Delete("a1")
+	if err := db.Write(&b); err != nil {
+		t.Fatal(err)
+	}
+
+	put := next(t, events)
+	if put.Type != EventPut || put.Key != "a1" || put.Value != "value1" || put.ValueType != TypeString {
+		t.Errorf("Bad put event: %+v", put)
+	}
+	batchPut, batchDelete := next(t, events), next(t, events)
+	if batchPut.Key != "a2" || batchDelete.Type != EventDelete || batchDelete.Key != "a1" {
+		t.Errorf("Bad batch events: %+v, %+v", batchPut, batchDelete)
+	}
+	if !(put.Seq < batchPut.Seq && batchPut.Seq < batchDelete.Seq) {
+		t.Errorf("Events are out of order: %d, %d, %d", put.Seq, batchPut.Seq, batchDelete.Seq)
+	}
+
+	cancel()
+	for range events {
+	}
+
+	t.Run("resumes from the segments", func(t *testing.T) {
+		for i := 0; i < 10; i++ {
+			if err := db.Put(fmt.Sprintf("a%d", i), "more"); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		events, err := db.WatchFrom(ctx, "a", put.Seq)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := db.Put("a-live", "value"); err != nil {
+			t.Fatal(err)
+		}
+
+		seq := put.Seq
+		var keys []string
+		for len(keys) < 13 {
+			e := next(t, events)
+			if e.Seq <= seq {
+				t.Fatalf("Event %d came after %d", e.Seq, seq)
+			}
+			seq = e.Seq
+			keys = append(keys, e.Key)
+		}
+		if keys[0] != "a2" || keys[1] != "a1" || keys[12] != "a-live" {
+			t.Errorf("Unexpected events: %v", keys)
+		}
+	})
+
+	t.Run("refuses compacted changes", func(t *testing.T) {
+		if err := db.Compact(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		compacted := db.segmentList()[0].version
+		if compacted <= put.Seq {
+			t.Fatalf("Compaction merged up to %d only", compacted)
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		if _, err := db.WatchFrom(ctx, "a", put.Seq); !errors.Is(err, ErrCompacted) {
+			t.Errorf("Expected ErrCompacted, got %v", err)
+		}
+		if _, err := db.WatchFrom(ctx, "a", compacted); err != nil {
+			t.Errorf("Cannot resume after the compacted writes: %s", err)
+		}
+		events, err := db.WatchFrom(ctx, "a", 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if e := next(t, events); e.Type != EventPut {
+			t.Errorf("Full replay starts with %+v", e)
+		}
+
+		db.Close()
+		reopened, err := Open(dir, WithSegmentSize(200), WithCompaction(CompactionPolicy{Disabled: true}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		db = reopened
+		if _, err := db.WatchFrom(ctx, "a", put.Seq); !errors.Is(err, ErrCompacted) {
+			t.Errorf("Expected ErrCompacted after reopening, got %v", err)
+		}
+	})
+
+	t.Run("drops slow watchers", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		events := db.Watch(ctx, "")
+		for i := 0; i < watchBuffer+10; i++ {
+			if err := db.PutInt64("counter", int64(i)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		count := 0
+		for range events {
+			count++
+		}
+		if count > watchBuffer+1 {
+			t.Errorf("Slow watcher got all %d events", count)
+		}
+	})
+}
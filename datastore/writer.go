@@ -0,0 +1,272 @@
+package datastore
+
+import "time"
+
+// maxGroupSize limits how many pending write operations the put routine
+// combines into a single write and fsync.
+const maxGroupSize = 128
+
+// SyncMode tells when records appended to a segment are flushed to disk.
+type SyncMode int
+
+const (
+	// SyncNever leaves flushing to the operating system.
+	SyncNever SyncMode = iota
+	// SyncAlways flushes the segment before a write is acknowledged.
+	SyncAlways
+	// SyncInterval flushes the segment in the background every
+	// Options.SyncInterval. A crash may lose writes of the last period.
+	SyncInterval
+)
+
+func (m SyncMode) String() string {
+	switch m {
+	case SyncNever:
+		return "never"
+	case SyncAlways:
+		return "always"
+	case SyncInterval:
+		return "interval"
+	default:
+		return "unknown"
+	}
+}
+
+// writtenRecord describes a record appended to the active segment.
+type writtenRecord struct {
+	key     string
+	size    int64
+	deleted bool
+	// marker records, such as batch commits, hold no key.
+	marker bool
+}
+
+// writeOp is a unit of work for the put routine. All of its entries are
+// appended to the active segment with a single write.
+type writeOp struct {
+	entries []entry
+	batch   bool
+	// replicated entries keep the versions they were given by another store.
+	replicated bool
+	done       chan error
+	err        error
+}
+
+// group collects the encoded records of several write operations so that
+// they reach the segment file with a single write.
+type group struct {
+	data    []byte
+	records []writtenRecord
+	ops     []*writeOp
+}
+
+func (db *Db) startPutRoutine() {
+	var tick <-chan time.Time
+	var ticker *time.Ticker
+	if db.syncMode == SyncInterval {
+		ticker = time.NewTicker(db.syncInterval)
+		tick = ticker.C
+	}
+
+	db.writer.Add(1)
+	go func() {
+		defer db.writer.Done()
+		if ticker != nil {
+			defer ticker.Stop()
+		}
+		for {
+			select {
+			case <-db.closing:
+				return
+			case op := <-db.putOps:
+				db.writeGroup(db.drainPutOps(op))
+			case reply := <-db.snapshotOps:
+				reply <- db.takeSnapshot()
+			case <-tick:
+				if db.unsynced {
+					if err := db.out.Sync(); err != nil {
+						db.logger.Printf("Failed to sync %s: %s", db.outPath, err)
+						continue
+					}
+					db.unsynced = false
+				}
+			}
+		}
+	}()
+}
+
+// drainPutOps returns op together with the operations already waiting in
+// the queue, so that they can be committed at once.
+func (db *Db) drainPutOps(op *writeOp) []*writeOp {
+	ops := []*writeOp{op}
+	for len(ops) < maxGroupSize {
+		select {
+		case op := <-db.putOps:
+			ops = append(ops, op)
+		default:
+			return ops
+		}
+	}
+	return ops
+}
+
+// writeGroup appends the records of all operations to the active segment,
+// syncs it once if required and then reports the results to all callers.
+func (db *Db) writeGroup(ops []*writeOp) {
+	var g group
+	for _, op := range ops {
+		if op.hasUpdates() {
+			// Updates read the current state of the store, so everything
+			// queued before them must be visible first.
+			db.flush(&g)
+			if err := op.update(); err != nil {
+				op.err = err
+				continue
+			}
+		}
+
+		for i := range op.entries {
+			if !op.replicated {
+				op.entries[i].version = db.version.Add(1)
+			} else if v := op.entries[i].version; v > db.version.Load() {
+				db.version.Store(v)
+			}
+		}
+		data, records := op.encode()
+		// A record bigger than a segment is written to its own one instead
+		// of sealing an empty segment.
+		if size := db.outOffset + int64(len(g.data)); size > 0 && size+int64(len(data)) > db.segmentSize {
+			db.flush(&g)
+			if err := db.sealSegment(); err != nil {
+				op.err = err
+				continue
+			}
+		}
+		for _, e := range op.entries {
+			if e.version > db.outVersion {
+				db.outVersion = e.version
+			}
+		}
+
+		g.data = append(g.data, data...)
+		g.records = append(g.records, records...)
+		g.ops = append(g.ops, op)
+	}
+	db.flush(&g)
+
+	if db.syncMode == SyncAlways && db.unsynced {
+		err := db.out.Sync()
+		if err == nil {
+			db.unsynced = false
+		}
+		for _, op := range ops {
+			if op.err == nil {
+				op.err = err
+			}
+		}
+	}
+
+	db.publish(ops)
+	for _, op := range ops {
+		op.done <- op.err
+	}
+}
+
+// flush writes the collected records to the active segment and waits for the
+// index to be updated.
+func (db *Db) flush(g *group) {
+	if len(g.ops) == 0 {
+		return
+	}
+
+	_, err := db.out.Write(g.data)
+	if err == nil {
+		db.unsynced = true
+
+		// Wait for the index update, otherwise the next put may switch
+		// to a new segment before this key is recorded in the old one.
+		indexed := make(chan struct{})
+		db.indexOps <- IndexOp{
+			isWrite: true,
+			records: g.records,
+			done:    indexed,
+		}
+		<-indexed
+	}
+
+	for _, op := range g.ops {
+		op.err = err
+	}
+	*g = group{}
+}
+
+// sealSegment switches writes to a new segment. The sealed one is synced
+// first unless the store never syncs, and its index is saved as a hint.
+func (db *Db) sealSegment() error {
+	if db.syncMode != SyncNever && db.unsynced {
+		if err := db.out.Sync(); err != nil {
+			return err
+		}
+		db.unsynced = false
+	}
+	sealed := db.getLastSegment()
+	sealed.version = db.outVersion
+	if err := sealed.writeHint(db.outVersion, db.fileMode); err != nil {
+		db.logger.Printf("Failed to write hint for %s: %s", db.outPath, err)
+	}
+	if err := db.createSegment(); err != nil {
+		return err
+	}
+	db.outVersion = 0
+	return nil
+}
+
+func (op *writeOp) hasUpdates() bool {
+	for _, e := range op.entries {
+		if e.update != nil {
+			return true
+		}
+	}
+	return false
+}
+
+func (op *writeOp) update() error {
+	for i := range op.entries {
+		if update := op.entries[i].update; update != nil {
+			if err := update(&op.entries[i]); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// encode returns the bytes to append for the operation and the records they
+// consist of.
+func (op *writeOp) encode() ([]byte, []writtenRecord) {
+	var data []byte
+	var records []writtenRecord
+
+	for _, e := range op.entries {
+		e.batched = op.batch
+		encoded := e.Encode()
+		data = append(data, encoded...)
+		records = append(records, writtenRecord{
+			key:     e.key,
+			size:    int64(len(encoded)),
+			deleted: e.deleted,
+		})
+	}
+
+	if op.batch {
+		commit := commitEntry(len(op.entries))
+		encoded := commit.Encode()
+		data = append(data, encoded...)
+		records = append(records, writtenRecord{
+			size:   int64(len(encoded)),
+			marker: true,
+		})
+	}
+
+	return data, records
+}
@@ -0,0 +1,80 @@
+package integration
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+const (
+	leaderAddress   = "http://db:8083"
+	followerAddress = "http://db-replica:8083"
+)
+
+type ReplicationIntegrationSuite struct{}
+
+var _ = Suite(&ReplicationIntegrationSuite{})
+
+type ReplicationBody struct {
+	Role    string `json:"role"`
+	Version int64  `json:"version"`
+	Lag     int64  `json:"lag"`
+}
+
+func (s *ReplicationIntegrationSuite) TestConvergence(c *C) {
+	if _, exists := os.LookupEnv("INTEGRATION_ENV"); !exists {
+		c.Skip("Integration test is not enabled")
+	}
+
+	key := fmt.Sprintf("replicated-%d", time.Now().UnixNano())
+	body, _ := json.Marshal(map[string]string{"value": "from-leader"})
+	resp, err := client.Post(fmt.Sprintf("%s/db/default/%s", leaderAddress, key), "application/json", bytes.NewReader(body))
+	c.Assert(err, IsNil)
+	resp.Body.Close()
+	c.Assert(resp.StatusCode, Equals, http.StatusCreated)
+
+	var value ResponseBody
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		resp, err := client.Get(fmt.Sprintf("%s/db/default/%s", followerAddress, key))
+		c.Assert(err, IsNil)
+		if resp.StatusCode == http.StatusOK {
+			err = json.NewDecoder(resp.Body).Decode(&value)
+			resp.Body.Close()
+			c.Assert(err, IsNil)
+			break
+		}
+		resp.Body.Close()
+		if time.Now().After(deadline) {
+			c.Fatalf("%s did not reach the follower", key)
+		}
+		time.Sleep(200 * time.Millisecond)
+	}
+	c.Check(value.Value, Equals, "from-leader")
+
+	noRedirect := http.Client{
+		Timeout: client.Timeout,
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	resp, err = noRedirect.Post(fmt.Sprintf("%s/db/default/%s", followerAddress, key), "application/json", bytes.NewReader(body))
+	c.Assert(err, IsNil)
+	resp.Body.Close()
+	c.Check(resp.StatusCode, Equals, http.StatusTemporaryRedirect)
+	c.Check(resp.Header.Get("Location"), Equals, fmt.Sprintf("%s/db/default/%s", leaderAddress, key))
+
+	resp, err = client.Get(followerAddress + "/admin/replication")
+	c.Assert(err, IsNil)
+	var status ReplicationBody
+	err = json.NewDecoder(resp.Body).Decode(&status)
+	resp.Body.Close()
+	c.Assert(err, IsNil)
+	c.Check(status.Role, Equals, "follower")
+	c.Check(status.Version > 0, Equals, true)
+}
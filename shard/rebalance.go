@@ -0,0 +1,208 @@
+package shard
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// listLimit is the page size used to list the keys of a node.
+const listLimit = 1000
+
+// RebalanceStats counts the keys a rebalance looked at and moved.
+type RebalanceStats struct {
+	Scanned int
+	Moved   int
+}
+
+// listItem and listResp follow the list response of GET /db/<namespace>/
+// of cmd/db.
+type listItem struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+	Type  string `json:"type"`
+}
+
+type listResp struct {
+	Items      []listItem `json:"items"`
+	NextCursor string     `json:"next_cursor"`
+}
+
+// Rebalance moves every key of the nodes of from that belongs to another
+// node of to, then deletes it from the old node. With a consistent-hash ring
+// only the keys next to the added or removed nodes move.
+//
+// Servers should route through to before the rebalance starts. Values are
+// copied with If-None-Match: *, so a value written to the new owner in the
+// meantime is newer and kept, whatever its type. Expiry times are kept,
+// versions are not.
+func Rebalance(ctx context.Context, client *http.Client, namespace string, from, to *Ring) (RebalanceStats, error) {
+	var stats RebalanceStats
+	for _, node := range from.Nodes() {
+		cursor := ""
+		for {
+			page, err := list(ctx, client, node+"/db/"+url.PathEscape(namespace), cursor)
+			if err != nil {
+				return stats, err
+			}
+			for _, item := range page.Items {
+				stats.Scanned++
+				owner := to.Node(item.Key)
+				if owner == node || owner == "" {
+					continue
+				}
+				if err := move(ctx, client, namespace, node, owner, item); err != nil {
+					return stats, fmt.Errorf("cannot move %s from %s to %s: %w", item.Key, node, owner, err)
+				}
+				stats.Moved++
+			}
+			if page.NextCursor == "" {
+				break
+			}
+			cursor = page.NextCursor
+		}
+	}
+	return stats, nil
+}
+
+func list(ctx context.Context, client *http.Client, base, cursor string) (*listResp, error) {
+	query := url.Values{"limit": {strconv.Itoa(listLimit)}}
+	if cursor != "" {
+		query.Set("cursor", cursor)
+	}
+	resp, err := do(ctx, client, http.MethodGet, base+"/?"+query.Encode(), nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("listing %s: %s", base, resp.Status)
+	}
+	var page listResp
+	if err := json.NewDecoder(resp.Body).Decode(&page); err != nil {
+		return nil, err
+	}
+	return &page, nil
+}
+
+// move copies the item to the new owner and deletes it from the old one.
+func move(ctx context.Context, client *http.Client, namespace, from, to string, item listItem) error {
+	path := "/db/" + url.PathEscape(namespace) + "/" + url.PathEscape(item.Key)
+	var (
+		target = to + path
+		body   []byte
+		header = make(http.Header)
+		err    error
+	)
+	switch item.Type {
+	case "string":
+		// The list leaves out expiry times, so the value is read again.
+		current, err := get(ctx, client, from+path)
+		if err != nil {
+			return err
+		}
+		if current == nil {
+			// Expired or deleted since it was listed.
+			return nil
+		}
+		req := map[string]string{"value": current.Value}
+		if current.ExpiresAt != nil {
+			ttl := time.Until(*current.ExpiresAt)
+			if ttl <= 0 {
+				return nil
+			}
+			req["ttl"] = ttl.String()
+		}
+		body, err = json.Marshal(req)
+		if err != nil {
+			return err
+		}
+	case "int64":
+		value, err := strconv.ParseInt(item.Value, 10, 64)
+		if err != nil {
+			return err
+		}
+		target += "?type=int64"
+		body, _ = json.Marshal(map[string]int64{"value": value})
+	case "bytes":
+		target += "?type=bytes"
+		header.Set("content-type", "application/octet-stream")
+		if body, err = base64.StdEncoding.DecodeString(item.Value); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("unknown value type %q", item.Type)
+	}
+
+	// 412 means the new owner has a newer value, which is kept.
+	header.Set("If-None-Match", "*")
+	resp, err := do(ctx, client, http.MethodPost, target, header, body)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated && resp.StatusCode != http.StatusPreconditionFailed {
+		return fmt.Errorf("writing to %s: %s", to, resp.Status)
+	}
+
+	resp, err = do(ctx, client, http.MethodDelete, from+path, nil, nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("deleting from %s: %s", from, resp.Status)
+	}
+	return nil
+}
+
+type stringValue struct {
+	Value     string     `json:"value"`
+	ExpiresAt *time.Time `json:"expires_at"`
+}
+
+// get reads a string value, or returns nil if the key is missing.
+func get(ctx context.Context, client *http.Client, target string) (*stringValue, error) {
+	resp, err := do(ctx, client, http.MethodGet, target, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return nil, nil
+	default:
+		return nil, fmt.Errorf("reading %s: %s", target, resp.Status)
+	}
+	var value stringValue
+	if err := json.NewDecoder(resp.Body).Decode(&value); err != nil {
+		return nil, err
+	}
+	return &value, nil
+}
+
+func do(ctx context.Context, client *http.Client, method, target string, header http.Header, body []byte) (*http.Response, error) {
+	var in io.Reader
+	if body != nil {
+		in = bytes.NewReader(body)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, target, in)
+	if err != nil {
+		return nil, err
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	if body != nil && req.Header.Get("content-type") == "" {
+		req.Header.Set("content-type", "application/json")
+	}
+	return client.Do(req)
+}
@@ -0,0 +1,148 @@
+package shard
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeNode serves the parts of the API of cmd/db that Rebalance uses.
+type fakeNode struct {
+	mu     sync.Mutex
+	values map[string]listItem
+}
+
+func (n *fakeNode) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	key := strings.TrimPrefix(req.URL.Path, "/db/test/")
+	switch {
+	case req.Method == http.MethodGet && key == "":
+		keys := make([]string, 0, len(n.values))
+		for k := range n.values {
+			if k >= req.URL.Query().Get("cursor") {
+				keys = append(keys, k)
+			}
+		}
+		sort.Strings(keys)
+		limit, _ := strconv.Atoi(req.URL.Query().Get("limit"))
+		resp := listResp{Items: []listItem{}}
+		for i, k := range keys {
+			if i == limit {
+				resp.NextCursor = k
+				break
+			}
+			resp.Items = append(resp.Items, n.values[k])
+		}
+		_ = json.NewEncoder(rw).Encode(resp)
+	case req.Method == http.MethodGet:
+		item, ok := n.values[key]
+		if !ok {
+			rw.WriteHeader(http.StatusNotFound)
+			return
+		}
+		_ = json.NewEncoder(rw).Encode(item)
+	case req.Method == http.MethodPost:
+		if _, ok := n.values[key]; ok && req.Header.Get("If-None-Match") == "*" {
+			rw.WriteHeader(http.StatusPreconditionFailed)
+			return
+		}
+		item := listItem{Key: key, Type: req.URL.Query().Get("type")}
+		data, _ := io.ReadAll(req.Body)
+		switch item.Type {
+		case "bytes":
+			item.Value = base64.StdEncoding.EncodeToString(data)
+		case "int64":
+			var body struct{ Value int64 }
+			_ = json.Unmarshal(data, &body)
+			item.Value = strconv.FormatInt(body.Value, 10)
+		default:
+			var body struct{ Value string }
+			_ = json.Unmarshal(data, &body)
+			item.Type, item.Value = "string", body.Value
+		}
+		n.values[key] = item
+		rw.WriteHeader(http.StatusCreated)
+	case req.Method == http.MethodDelete:
+		delete(n.values, key)
+	}
+}
+
+func TestRebalance(t *testing.T) {
+	nodes := make(map[string]*fakeNode)
+	var urls []string
+	for i := 0; i < 3; i++ {
+		node := &fakeNode{values: make(map[string]listItem)}
+		server := httptest.NewServer(node)
+		defer server.Close()
+		nodes[server.URL] = node
+		urls = append(urls, server.URL)
+	}
+
+	from := NewRing(0, urls[:2]...)
+	const keys = 2500
+	for i := 0; i < keys; i++ {
+		item := listItem{Key: fmt.Sprintf("key%d", i), Value: fmt.Sprintf("value%d", i), Type: "string"}
+		if i%10 == 0 {
+			item.Value, item.Type = strconv.Itoa(i), "int64"
+		}
+		nodes[from.Node(item.Key)].values[item.Key] = item
+	}
+
+	to := NewRing(0, urls...)
+	// A value written to the new owner before the rebalance is newer and
+	// is kept.
+	var newer string
+	for i := 0; newer == ""; i += 10 {
+		if key := fmt.Sprintf("key%d", i); to.Node(key) == urls[2] {
+			newer = key
+		}
+	}
+	nodes[urls[2]].values[newer] = listItem{Key: newer, Value: "-1", Type: "int64"}
+
+	stats, err := Rebalance(context.Background(), http.DefaultClient, "test", from, to)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Scanned != keys {
+		t.Errorf("Scanned %d keys, expected %d", stats.Scanned, keys)
+	}
+	if stats.Moved != len(nodes[urls[2]].values) || stats.Moved == 0 {
+		t.Errorf("Moved %d keys, the added node has %d", stats.Moved, len(nodes[urls[2]].values))
+	}
+
+	total := 0
+	for url, node := range nodes {
+		for key, item := range node.values {
+			if owner := to.Node(key); owner != url {
+				t.Fatalf("%s is on %s, expected %s", key, url, owner)
+			}
+			if key == newer {
+				if item.Value != "-1" {
+					t.Errorf("Newer value of %s was overwritten: %+v", key, item)
+				}
+				continue
+			}
+			i, _ := strconv.Atoi(strings.TrimPrefix(key, "key"))
+			if i%10 == 0 && (item.Type != "int64" || item.Value != strconv.Itoa(i)) {
+				t.Errorf("Bad int64 value of %s: %+v", key, item)
+			}
+			if i%10 != 0 && item.Value != fmt.Sprintf("value%d", i) {
+				t.Errorf("Bad value of %s: %+v", key, item)
+			}
+		}
+		total += len(node.values)
+	}
+	if total != keys {
+		t.Errorf("Expected %d keys after the rebalance, got %d", keys, total)
+	}
+}
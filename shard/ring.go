@@ -0,0 +1,143 @@
+// Package shard spreads the keyspace over several db nodes with a
+// consistent-hash ring.
+package shard
+
+import (
+	"crypto/sha1"
+	"encoding/binary"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// DefaultReplicas is the number of virtual nodes a node gets on the ring
+// when NewRing is given zero.
+const DefaultReplicas = 128
+
+// Ring maps keys to nodes. Every node is placed on the ring many times, as
+// virtual nodes, so keys spread evenly and adding or removing a node only
+// moves the keys between it and its neighbours. A Ring is safe for
+// concurrent use.
+type Ring struct {
+	replicas int
+
+	mu     sync.RWMutex
+	hashes []uint64
+	owners map[uint64]string
+	nodes  map[string]struct{}
+}
+
+func NewRing(replicas int, nodes ...string) *Ring {
+	if replicas <= 0 {
+		replicas = DefaultReplicas
+	}
+	r := &Ring{
+		replicas: replicas,
+		owners:   make(map[uint64]string),
+		nodes:    make(map[string]struct{}),
+	}
+	for _, node := range nodes {
+		r.Add(node)
+	}
+	return r
+}
+
+// Add places the node on the ring. Adding a node twice does nothing.
+func (r *Ring) Add(node string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.nodes[node]; ok {
+		return
+	}
+	r.nodes[node] = struct{}{}
+	for i := 0; i < r.replicas; i++ {
+		h := hash(node + "#" + strconv.Itoa(i))
+		// On the rare collision the smaller name wins, so the ring does not
+		// depend on the order nodes were added in.
+		if owner, ok := r.owners[h]; ok {
+			if owner < node {
+				continue
+			}
+		} else {
+			r.hashes = append(r.hashes, h)
+		}
+		r.owners[h] = node
+	}
+	sort.Slice(r.hashes, func(i, j int) bool { return r.hashes[i] < r.hashes[j] })
+}
+
+// Remove takes the node off the ring.
+func (r *Ring) Remove(node string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.nodes[node]; !ok {
+		return
+	}
+	delete(r.nodes, node)
+	r.hashes = r.hashes[:0]
+	for h, owner := range r.owners {
+		if owner == node {
+			delete(r.owners, h)
+		}
+	}
+	// Virtual nodes the removed node took over on a collision go back to
+	// the others.
+	for other := range r.nodes {
+		for i := 0; i < r.replicas; i++ {
+			h := hash(other + "#" + strconv.Itoa(i))
+			if owner, ok := r.owners[h]; !ok || other < owner {
+				r.owners[h] = other
+			}
+		}
+	}
+	for h := range r.owners {
+		r.hashes = append(r.hashes, h)
+	}
+	sort.Slice(r.hashes, func(i, j int) bool { return r.hashes[i] < r.hashes[j] })
+}
+
+// Node returns the node that owns the key, or "" if the ring is empty.
+func (r *Ring) Node(key string) string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if len(r.hashes) == 0 {
+		return ""
+	}
+	h := hash(key)
+	i := sort.Search(len(r.hashes), func(i int) bool { return r.hashes[i] >= h })
+	if i == len(r.hashes) {
+		i = 0
+	}
+	return r.owners[r.hashes[i]]
+}
+
+// Nodes returns the nodes of the ring in sorted order.
+func (r *Ring) Nodes() []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	nodes := make([]string, 0, len(r.nodes))
+	for node := range r.nodes {
+		nodes = append(nodes, node)
+	}
+	sort.Strings(nodes)
+	return nodes
+}
+
+func hash(s string) uint64 {
+	sum := sha1.Sum([]byte(s))
+	return binary.BigEndian.Uint64(sum[:])
+}
+
+// ParseNodes splits a comma separated list of node URLs, dropping blanks
+// and trailing slashes.
+func ParseNodes(list string) []string {
+	var nodes []string
+	for _, node := range strings.Split(list, ",") {
+		node = strings.TrimSuffix(strings.TrimSpace(node), "/")
+		if node != "" {
+			nodes = append(nodes, node)
+		}
+	}
+	return nodes
+}
@@ -0,0 +1,76 @@
+package shard
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestRing_Distribution(t *testing.T) {
+	nodes := []string{"http://db1:8083", "http://db2:8083", "http://db3:8083", "http://db4:8083"}
+	ring := NewRing(0, nodes...)
+
+	const keys = 40000
+	counts := make(map[string]int)
+	for i := 0; i < keys; i++ {
+		counts[ring.Node(fmt.Sprintf("key%d", i))]++
+	}
+	for _, node := range nodes {
+		share := float64(counts[node]) / keys
+		if share < 0.15 || share > 0.35 {
+			t.Errorf("Node %s got %.1f%% of the keys", node, share*100)
+		}
+	}
+
+	reversed := NewRing(0, nodes[3], nodes[2], nodes[1], nodes[0])
+	for i := 0; i < 1000; i++ {
+		key := fmt.Sprintf("key%d", i)
+		if ring.Node(key) != reversed.Node(key) {
+			t.Fatalf("The owner of %s depends on the order of nodes", key)
+		}
+	}
+}
+
+func TestRing_AddRemove(t *testing.T) {
+	ring := NewRing(0, "a", "b", "c")
+	const keys = 10000
+	before := make([]string, keys)
+	for i := range before {
+		before[i] = ring.Node(fmt.Sprintf("key%d", i))
+	}
+
+	ring.Add("d")
+	moved := 0
+	for i, owner := range before {
+		now := ring.Node(fmt.Sprintf("key%d", i))
+		if now != owner {
+			if now != "d" {
+				t.Fatalf("key%d moved from %s to %s, not to the added node", i, owner, now)
+			}
+			moved++
+		}
+	}
+	if moved == 0 || moved > keys/2 {
+		t.Errorf("Adding a node to 3 moved %d of %d keys", moved, keys)
+	}
+
+	ring.Remove("d")
+	for i, owner := range before {
+		if now := ring.Node(fmt.Sprintf("key%d", i)); now != owner {
+			t.Fatalf("key%d belongs to %s after removing the added node, not %s", i, now, owner)
+		}
+	}
+	if nodes := ring.Nodes(); len(nodes) != 3 {
+		t.Errorf("Unexpected nodes: %v", nodes)
+	}
+
+	if NewRing(0).Node("key") != "" {
+		t.Error("Empty ring returned a node")
+	}
+}
+
+func TestParseNodes(t *testing.T) {
+	nodes := ParseNodes(" http://db1:8083/, ,http://db2:8083")
+	if len(nodes) != 2 || nodes[0] != "http://db1:8083" || nodes[1] != "http://db2:8083" {
+		t.Errorf("Unexpected nodes: %q", nodes)
+	}
+}